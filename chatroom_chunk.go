@@ -0,0 +1,137 @@
+package chatroom
+
+import (
+	"strings"
+	"time"
+)
+
+// The default bound on the reassembled size of a chunked message.
+const defaultMaxStreamBytes = 1 << 20
+
+// The default time a chunked message may take to arrive completely.
+const defaultStreamTimeout = 30 * time.Second
+
+// The number of chunked messages a connection may be sending at once.
+const maxOpenStreams = 8
+
+// A chunkStream is a chunked message being reassembled.
+type chunkStream struct {
+	// chunks holds the chunk bodies by index, they may arrive in any order.
+	chunks map[int]string
+	// size is the number of bytes received so far, each chunk counts at least one byte.
+	size int
+	// last is the index of the last chunk, or -1 until the chunk marked Last arrives.
+	last   int
+	binary bool
+	// done is closed once the stream is complete or dropped, so its timeout stops waiting.
+	done chan struct{}
+}
+
+// Adds a chunk to its stream. Once all chunks from 0 to the one marked Last have arrived,
+// returns the reassembled chat message and true.
+// Invalid chunks and streams that grow beyond MaxStreamBytes are dropped with an error to the sender.
+func (s *ChatServer) addChunk(conn *connection, chunk Message) (message Message, ok bool) {
+	message, reason, errBody := s.storeChunk(conn, chunk)
+	if reason != "" {
+		s.logger.Println(conn.t.RemoteAddr(), "sent a bad chunk:", errBody)
+		conn.reply(s.localize(conn.locale, Message{Type: MessageTypeError, Body: errBody, Reason: reason, StreamID: chunk.StreamID}))
+		return Message{}, false
+	}
+	return message, message.Type != ""
+}
+
+// Stores the chunk under the connection's stream lock, see addChunk.
+// Returns the reassembled message if the stream is complete, or an error reason and body if the chunk is rejected.
+func (s *ChatServer) storeChunk(conn *connection, chunk Message) (message Message, reason, errBody string) {
+	if chunk.StreamID == "" || chunk.Chunk < 0 {
+		return Message{}, ReasonBadChunk, "Chunks need a stream_id and a chunk index from 0."
+	}
+	conn.streamsMu.Lock()
+	defer conn.streamsMu.Unlock()
+	stream := conn.streams[chunk.StreamID]
+	if stream == nil {
+		if len(conn.streams) >= maxOpenStreams {
+			return Message{}, ReasonBadChunk, "Too many chunked messages in progress."
+		}
+		if conn.streams == nil {
+			conn.streams = make(map[string]*chunkStream)
+		}
+		stream = &chunkStream{chunks: make(map[int]string), last: -1, binary: chunk.Binary, done: make(chan struct{})}
+		conn.streams[chunk.StreamID] = stream
+		go s.expireStream(conn, chunk.StreamID, stream)
+	}
+	if _, seen := stream.chunks[chunk.Chunk]; seen || (stream.last >= 0 && (chunk.Last || chunk.Chunk > stream.last)) {
+		conn.dropStream(chunk.StreamID, stream)
+		return Message{}, ReasonBadChunk, "Chunk is repeated or beyond the last chunk."
+	}
+	if chunk.Last {
+		for index := range stream.chunks {
+			if index > chunk.Chunk {
+				conn.dropStream(chunk.StreamID, stream)
+				return Message{}, ReasonBadChunk, "Chunk is repeated or beyond the last chunk."
+			}
+		}
+		stream.last = chunk.Chunk
+	}
+	stream.size += max(len(chunk.Body), 1)
+	if stream.size > s.maxStreamBytes() {
+		conn.dropStream(chunk.StreamID, stream)
+		return Message{}, ReasonStreamTooLarge, "Chunked message is too large."
+	}
+	stream.chunks[chunk.Chunk] = chunk.Body
+	if stream.last < 0 || len(stream.chunks) != stream.last+1 {
+		return Message{}, "", ""
+	}
+	var body strings.Builder
+	for index := 0; index <= stream.last; index++ {
+		body.WriteString(stream.chunks[index])
+	}
+	conn.dropStream(chunk.StreamID, stream)
+	return Message{Type: MessageTypeChat, Body: body.String(), Binary: stream.binary}, "", ""
+}
+
+// Drops the stream if it has not completed within StreamTimeout, and tells the sender.
+func (s *ChatServer) expireStream(conn *connection, streamID string, stream *chunkStream) {
+	timeout := s.StreamTimeout
+	if timeout <= 0 {
+		timeout = defaultStreamTimeout
+	}
+	select {
+	case <-stream.done:
+		return
+	case <-s.clock().After(timeout):
+	}
+	conn.streamsMu.Lock()
+	expired := conn.streams[streamID] == stream
+	if expired {
+		conn.dropStream(streamID, stream)
+	}
+	conn.streamsMu.Unlock()
+	if expired {
+		s.logger.Println(conn.t.RemoteAddr(), "did not complete chunked message", streamID)
+		conn.send(s.localize(conn.locale, Message{Type: MessageTypeError, Body: "Chunked message timed out.", Reason: ReasonStreamTimeout, StreamID: streamID}))
+	}
+}
+
+// Returns the bound on the reassembled size of a chunked message.
+func (s *ChatServer) maxStreamBytes() int {
+	if s.MaxStreamBytes <= 0 {
+		return defaultMaxStreamBytes
+	}
+	return s.MaxStreamBytes
+}
+
+// Removes the stream from the connection and stops its timeout, streamsMu must be held.
+func (conn *connection) dropStream(streamID string, stream *chunkStream) {
+	delete(conn.streams, streamID)
+	close(stream.done)
+}
+
+// Drops every stream of a connection that is gone.
+func (conn *connection) dropStreams() {
+	conn.streamsMu.Lock()
+	defer conn.streamsMu.Unlock()
+	for streamID, stream := range conn.streams {
+		conn.dropStream(streamID, stream)
+	}
+}
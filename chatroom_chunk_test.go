@@ -0,0 +1,78 @@
+package chatroom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChunksAreReassembledInAnyOrder(t *testing.T) {
+	s := newTestServer("")
+	sender := servePipe(t, s)
+	receiver := servePipe(t, s)
+	waitConns(t, s, 2)
+
+	for _, chunk := range []Message{
+		{Type: MessageTypeChunk, StreamID: "a", Chunk: 2, Body: "world", Last: true},
+		{Type: MessageTypeChunk, StreamID: "a", Chunk: 0, Body: "hello"},
+		{Type: MessageTypeChunk, StreamID: "a", Chunk: 1, Body: ", "},
+	} {
+		if err := sender.Send(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if message := receive(t, receiver); message.Type != MessageTypeChat || message.Body != "hello, world" {
+		t.Fatalf("got %+v", message)
+	}
+}
+
+func TestSendChunked(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	sender := connect(t, url, JSONProtocol, "", nil)
+	receiver := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 2)
+
+	data := []byte{0x00, 0xff, 0x10, 0x80, 0x7f}
+	if err := sender.SendChunked(data, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := receiver.ReadJSON(); err != nil || !message.Binary || message.Body != string(data) {
+		t.Fatalf("got %+v, %v", message, err)
+	}
+}
+
+func TestIncompleteChunksTimeOut(t *testing.T) {
+	s := newTestServer("")
+	clock := newFakeClock()
+	s.Clock = clock
+	s.StreamTimeout = time.Minute
+	sender := servePipe(t, s)
+	waitConns(t, s, 1)
+
+	sender.Send(Message{Type: MessageTypeChunk, StreamID: "a", Chunk: 1, Body: "lost", Last: true})
+	// The throughput sampler and the stream's timeout are waiting on the clock.
+	waitUntil(t, func() bool { return clock.Waiting() == 2 })
+	clock.Advance(time.Minute)
+	if message := receive(t, sender); message.Type != MessageTypeError || message.Reason != ReasonStreamTimeout || message.StreamID != "a" {
+		t.Fatalf("got %+v, want a stream_timeout error", message)
+	}
+	conn := s.serverConnPool.snapshot()[0]
+	conn.streamsMu.Lock()
+	defer conn.streamsMu.Unlock()
+	if len(conn.streams) != 0 {
+		t.Fatalf("%d streams left after the timeout", len(conn.streams))
+	}
+}
+
+func TestChunkedMessagesAreBounded(t *testing.T) {
+	s := newTestServer("")
+	s.MaxStreamBytes = 8
+	sender := servePipe(t, s)
+	waitConns(t, s, 1)
+
+	sender.Send(Message{Type: MessageTypeChunk, StreamID: "a", Chunk: 0, Body: "12345"})
+	go sender.Send(Message{Type: MessageTypeChunk, StreamID: "a", Chunk: 1, Body: "6789", Last: true})
+	if message := receive(t, sender); message.Type != MessageTypeError || message.Reason != ReasonStreamTooLarge {
+		t.Fatalf("got %+v, want a stream_too_large error", message)
+	}
+}
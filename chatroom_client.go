@@ -1,26 +1,96 @@
 package chatroom
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/websocket"
 )
 
+// The largest fraction HeartbeatJitter varies the heartbeat interval by, so it stays at least a tenth of itself.
+const maxHeartbeatJitter = 0.9
+
+// The capacity of the Messages and Control channels.
+const clientChannelBuffer = 16
+
+// ErrNotConnected is wrapped by the errors the client returns when it has no usable connection to the server.
+var ErrNotConnected = errors.New("not connected")
+
+// Errors wrapped by ReadJSON, ReadAny and WaitFor when the server rejected the connection, match them with errors.Is.
+// The server accepts the WebSocket before it checks the connection, so Register succeeds and the rejection
+// is the first message read. Read can not tell a rejection from a chat message.
+var (
+	ErrInvalidPassword = errors.New("incorrect password")
+	ErrServerFull      = errors.New("server is full")
+	ErrMaintenance     = errors.New("server is not accepting connections")
+)
+
 // ChatClient stores the server configuration and maintains the WebSocket connection to the server.
 type ChatClient struct {
-	ClientID   string
+	ClientID string
+	// FailFast makes Send and Read return an error immediately once the client knows the connection is dead,
+	// instead of blocking on the socket.
+	FailFast bool
+	// Listener registers the client as a read-only listener, it receives broadcasts but can not send messages.
+	Listener bool
+	// Echo asks the server to send the client's own messages back to it.
+	Echo bool
+	// Locale asks the server to send its own messages, such as errors and notices, in this locale.
+	// It needs a Localizer on the server, without one they stay in English.
+	Locale string
+	// StopAndWait asks the server to send each message only once the client acked the previous one with Ack.
+	// The server drops the connection if an ack does not arrive within its AckTimeout. It requires JSONProtocol.
+	StopAndWait bool
+	// HeartbeatJitter spreads heartbeats by randomly varying each interval by up to this fraction, 0.1 means ±10%.
+	// When set, the first heartbeat is also sent at a random point within the interval. Zero disables jitter.
+	// Fractions above maxHeartbeatJitter are capped, so an interval never shrinks to nothing.
+	HeartbeatJitter float64
+	// OnHeartbeatFailure is called with the error when a heartbeat can not be sent, once the connection is
+	// marked lost and before it is closed. It runs on the heartbeat goroutine and may call Reconnect to reconnect.
+	// Without it, the connection is just closed.
+	OnHeartbeatFailure func(err error)
+	// Clock is the source of time for the heartbeat, nil means the real clock.
+	Clock Clock
+	// Codec encodes messages sent with SendJSON and read with ReadJSON, nil means JSONCodec.
+	// It must match the chat server's Codec.
+	Codec Codec
+	// connMu guards conn, which a later Register replaces, it is read with activeConn.
+	connMu     sync.Mutex
 	conn       *websocket.Conn
 	chatServer *ServerConfig
+	// connected is set on Register and cleared when the heartbeat or a read/write detects a dead connection.
+	connected atomic.Bool
+	// ready is closed once Register has established the connection.
+	ready     chan struct{}
+	readyOnce sync.Once
+	// pending holds the messages WaitFor skipped, ReadJSON returns them first.
+	pending []Message
+	// lastDeliverySeq and missed track the delivery sequence numbers of the messages read.
+	lastDeliverySeq atomic.Uint64
+	missed          atomic.Uint64
+	// demuxOnce starts the reader goroutine that fills messages and control, see Messages.
+	demuxOnce sync.Once
+	messages  chan Message
+	control   chan Message
 }
 
 // ServerConfig stores the necessary information for connecting to the server
 type ServerConfig struct {
-	origin   string
-	protocol string
-	url_     *url.URL
+	origin    string
+	protocol  string
+	url_      *url.URL
+	tlsConfig *tls.Config
 }
 
 // ChatClient constructor, you should construct a serverConfig first.
@@ -28,6 +98,7 @@ func NewChatClient(clientID string, sc *ServerConfig) *ChatClient {
 	chatClient := new(ChatClient)
 	chatClient.ClientID = clientID
 	chatClient.chatServer = sc
+	chatClient.ready = make(chan struct{})
 	return chatClient
 }
 
@@ -44,26 +115,169 @@ func NewServerConfig(origin, protocol, url_string string) (serverConfig *ServerC
 	return serverConfig, nil
 }
 
-// TODO:Make the ClientID useful
+// ServerConfig constructor for the common case, takes only the ws:// or wss:// url of the chat server.
+// The origin is derived from the url, http://host for ws and https://host for wss, and no subprotocol is offered.
+func NewServerConfigFromURL(url_string string) (serverConfig *ServerConfig, err error) {
+	url_, err := url.Parse(url_string)
+	if err != nil {
+		return nil, err
+	}
+	var origin string
+	switch url_.Scheme {
+	case "ws":
+		origin = "http://" + url_.Host
+	case "wss":
+		origin = "https://" + url_.Host
+	default:
+		return nil, fmt.Errorf("Chat server url must use ws or wss, not %q.", url_.Scheme)
+	}
+	if url_.Host == "" {
+		return nil, fmt.Errorf("Chat server url has no host.")
+	}
+	return &ServerConfig{origin: origin, url_: url_}, nil
+}
+
+// Checks the configuration without connecting: the url must be a ws or wss url with a host,
+// the origin an absolute url and the protocol, if any, a valid WebSocket subprotocol token.
+// Register would otherwise only fail on these when it dials.
+func (sc *ServerConfig) Validate() error {
+	switch {
+	case sc.url_ == nil:
+		return fmt.Errorf("Chat server url is missing.")
+	case sc.url_.Scheme != "ws" && sc.url_.Scheme != "wss":
+		return fmt.Errorf("Chat server url must use ws or wss, not %q.", sc.url_.Scheme)
+	case sc.url_.Host == "":
+		return fmt.Errorf("Chat server url has no host.")
+	}
+	origin, err := url.Parse(sc.origin)
+	if err != nil {
+		return fmt.Errorf("Origin %q is not a valid url: %v", sc.origin, err)
+	}
+	if !origin.IsAbs() || origin.Host == "" {
+		return fmt.Errorf("Origin %q must be an absolute url with a host.", sc.origin)
+	}
+	if sc.protocol != "" && strings.IndexFunc(sc.protocol, isNotTokenChar) >= 0 {
+		return fmt.Errorf("Protocol %q is not a valid subprotocol name.", sc.protocol)
+	}
+	return nil
+}
+
+// Reports whether r can not appear in an HTTP token, which is what a WebSocket subprotocol name is.
+func isNotTokenChar(r rune) bool {
+	return r <= ' ' || r >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, r)
+}
+
+// Sets the TLS configuration used to dial a wss url, for example to present a client certificate.
+func (sc *ServerConfig) SetTLSConfig(config *tls.Config) {
+	sc.tlsConfig = config
+}
+
 // Register with the chat server,input the password if the server is not public.
+// Registering again replaces and closes the previous connection.
+// The ClientID is sent along, the server may require it.
+// The program exits if the connection can not be established, use Reconnect to get the error instead.
 func (c *ChatClient) Register(password string) {
-	c.chatServer.url_.RawQuery = "pwd=" + password
-	ws, err := websocket.Dial(c.chatServer.url_.String(), c.chatServer.protocol, c.chatServer.origin)
-	if err != nil {
+	if err := c.Reconnect(password); err != nil {
 		log.Fatal(err)
 	}
+}
+
+// Registers with the chat server like Register, but returns the error if the connection can not be
+// established instead of exiting, for example to reconnect from OnHeartbeatFailure.
+// A failed attempt leaves the previous connection, if any, in place.
+func (c *ChatClient) Reconnect(password string) error {
+	query := url.Values{}
+	query.Set("pwd", password)
+	if c.ClientID != "" {
+		query.Set("id", c.ClientID)
+	}
+	if c.Listener {
+		query.Set("role", roleListener)
+	}
+	if c.Echo {
+		query.Set("echo", "true")
+	}
+	if c.StopAndWait {
+		query.Set("ack", "true")
+	}
+	if c.Locale != "" {
+		query.Set("locale", c.Locale)
+	}
+	c.chatServer.url_.RawQuery = query.Encode()
+	config, err := websocket.NewConfig(c.chatServer.url_.String(), c.chatServer.origin)
+	if err != nil {
+		return err
+	}
+	if c.chatServer.protocol != "" {
+		config.Protocol = []string{c.chatServer.protocol}
+	}
+	config.TlsConfig = c.chatServer.tlsConfig
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	c.connMu.Lock()
+	previous := c.conn
 	c.conn = ws
+	c.connMu.Unlock()
+	// The server keeps broadcasting to the replaced connection until it is closed.
+	if previous != nil {
+		previous.Close()
+	}
+	c.connected.Store(true)
+	c.readyOnce.Do(func() { close(c.ready) })
 	// A goroutine function that keep WebSocket alive.
-	go keepWebsocketAlive(ws)
+	go c.keepWebsocketAlive(ws)
+	return nil
+}
+
+// Blocks until Register has established the connection with the chat server, or ctx is done.
+// Returns an error if ctx is done first or the connection has already been lost.
+func (c *ChatClient) WaitUntilReady(ctx context.Context) error {
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+		return fmt.Errorf("Websocket connection is not ready: %v", ctx.Err())
+	}
+	if !c.connected.Load() {
+		return fmt.Errorf("Websocket connection is lost: %w", ErrNotConnected)
+	}
+	return nil
+}
+
+// Returns the active connection, or an error wrapping ErrNotConnected if the client has not registered,
+// or if FailFast is set and the connection is known to be dead.
+func (c *ChatClient) checkConnected() (*websocket.Conn, error) {
+	ws := c.activeConn()
+	if ws == nil {
+		log.Println("Websocket connection do not establish, please register first.")
+		return nil, fmt.Errorf("Websocket connection do not establish, please register first: %w", ErrNotConnected)
+	}
+	if c.FailFast && !c.connected.Load() {
+		return nil, fmt.Errorf("Websocket connection is lost: %w", ErrNotConnected)
+	}
+	return ws, nil
 }
 
 // TODO: Send the message with json
 // Send the message to chat server, ensure you have registered with the server.
 func (c *ChatClient) Send(message string) (err error) {
-	if c.conn == nil {
-		log.Println("Websocket connection do not establish, please register first.")
-		return fmt.Errorf("Websocket connection do not establish, please register first.")
-	} else if err := websocket.Message.Send(c.conn, message); err != nil {
+	if ws, err := c.checkConnected(); err != nil {
+		return err
+	} else if err := websocket.Message.Send(ws, message); err != nil {
+		c.connected.Store(false)
+		log.Println("Can not send message to server:", err)
+		return fmt.Errorf("Can not send message to server: %v", err)
+	}
+	return nil
+}
+
+// Send the data to chat server as a binary frame, the server relays it to text clients as a binary frame.
+func (c *ChatClient) SendBinary(data []byte) (err error) {
+	if ws, err := c.checkConnected(); err != nil {
+		return err
+	} else if err := websocket.Message.Send(ws, data); err != nil {
+		c.connected.Store(false)
 		log.Println("Can not send message to server:", err)
 		return fmt.Errorf("Can not send message to server: %v", err)
 	}
@@ -73,25 +287,335 @@ func (c *ChatClient) Send(message string) (err error) {
 // TODO: Parse the message with json
 // Read the message from chat server, ensure you have registered with the server.
 func (c *ChatClient) Read() (message string, err error) {
-	if c.conn == nil {
-		log.Println("Websocket connection do not establish, please register first.")
-		return "", fmt.Errorf("Websocket connection do not establish, please register first.")
-	} else if err := websocket.Message.Receive(c.conn, &message); err != nil {
+	if ws, err := c.checkConnected(); err != nil {
+		return "", err
+	} else if err := websocket.Message.Receive(ws, &message); err != nil {
+		c.connected.Store(false)
 		log.Println("Can not receive message from server:", err)
 		return "", fmt.Errorf("Can not receive message from server: %v", err)
 	}
 	return message, nil
 }
 
+// Read the next frame from chat server as is, binary reports whether it was a binary frame.
+func (c *ChatClient) ReadFrame() (data []byte, binary bool, err error) {
+	var message Message
+	if ws, err := c.checkConnected(); err != nil {
+		return nil, false, err
+	} else if err := rawFrame.Receive(ws, &message); err != nil {
+		c.connected.Store(false)
+		log.Println("Can not receive message from server:", err)
+		return nil, false, fmt.Errorf("Can not receive message from server: %v", err)
+	}
+	return []byte(message.Body), message.Binary, nil
+}
+
+// Read the next frame from chat server and decode it with Codec if it holds a Message envelope, structured is then true.
+// Any other frame, such as the raw strings of TextProtocol, is returned as a chat Message with the frame as its Body
+// and structured false. It eases moving from Read to ReadJSON while both kinds of frames are around.
+func (c *ChatClient) ReadAny() (message Message, structured bool, err error) {
+	if len(c.pending) > 0 {
+		message, c.pending = c.pending[0], c.pending[1:]
+		return message, true, nil
+	}
+	data, binary, err := c.ReadFrame()
+	if err != nil {
+		return Message{}, false, err
+	}
+	codec := c.Codec
+	if codec == nil {
+		codec = JSONCodec
+	}
+	// Plain text can happen to be valid JSON, only an envelope with a Type counts.
+	if err := codec.Unmarshal(data, &message); err == nil && message.Type != "" {
+		c.trackDelivery(message)
+		return message, true, c.rejected(message)
+	}
+	return Message{Type: MessageTypeChat, Body: string(data), Binary: binary}, false, nil
+}
+
+// Send the Message envelope to chat server encoded with Codec, the server config must use JSONProtocol.
+// An empty Type is sent as a chat message.
+func (c *ChatClient) SendJSON(message Message) (err error) {
+	if message.Type == "" {
+		message.Type = MessageTypeChat
+	}
+	if ws, err := c.checkConnected(); err != nil {
+		return err
+	} else if err := wsCodec(c.Codec).Send(ws, message); err != nil {
+		c.connected.Store(false)
+		log.Println("Can not send message to server:", err)
+		return fmt.Errorf("Can not send message to server: %v", err)
+	}
+	return nil
+}
+
+// Send the body to chat server split into chunks of at most chunkSize bytes, the server config must use JSONProtocol.
+// The server reassembles them and broadcasts the body as one message, up to its MaxStreamBytes.
+// Set binary if body holds raw bytes rather than text.
+func (c *ChatClient) SendChunked(body []byte, chunkSize int, binary bool) (err error) {
+	if chunkSize <= 0 {
+		return fmt.Errorf("Chunk size must be positive.")
+	}
+	// The stream id only has to be unique among the client's own streams.
+	streamID := strconv.FormatUint(rand.Uint64(), 16)
+	for index := 0; ; index++ {
+		size := min(chunkSize, len(body))
+		last := size == len(body)
+		chunk := Message{Type: MessageTypeChunk, Body: string(body[:size]), Binary: binary, StreamID: streamID, Chunk: index, Last: last}
+		if err := c.SendJSON(chunk); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		body = body[size:]
+	}
+}
+
+// Acks a message read from chat server, so a StopAndWait server sends the next one.
+func (c *ChatClient) Ack(message Message) (err error) {
+	return c.SendJSON(Message{Type: MessageTypeAck, DeliverySeq: message.DeliverySeq})
+}
+
+// Read the Message envelope from chat server decoded with Codec, the server config must use JSONProtocol.
+func (c *ChatClient) ReadJSON() (message Message, err error) {
+	if len(c.pending) > 0 {
+		message, c.pending = c.pending[0], c.pending[1:]
+		return message, nil
+	}
+	if ws, err := c.checkConnected(); err != nil {
+		return Message{}, err
+	} else if err := wsCodec(c.Codec).Receive(ws, &message); err != nil {
+		// A frame that could not be decoded does not mean the connection is gone.
+		if !errors.Is(err, ErrBadFrame) {
+			c.connected.Store(false)
+		}
+		log.Println("Can not receive message from server:", err)
+		return Message{}, fmt.Errorf("Can not receive message from server: %v", err)
+	}
+	c.trackDelivery(message)
+	if err := c.rejected(message); err != nil {
+		return message, err
+	}
+	return message, nil
+}
+
+// Returns an error wrapping ErrInvalidPassword, ErrServerFull or ErrMaintenance if the message rejects the connection,
+// the connection is then considered lost. Returns nil for any other message.
+func (c *ChatClient) rejected(message Message) error {
+	var err error
+	switch {
+	case message.Type == MessageTypeMaintenance:
+		err = ErrMaintenance
+	case message.Type != MessageTypeError:
+		return nil
+	case message.Reason == ReasonIncorrectPassword:
+		err = ErrInvalidPassword
+	case message.Reason == ReasonServerFull, message.Reason == ReasonBusy:
+		err = ErrServerFull
+	default:
+		return nil
+	}
+	c.connected.Store(false)
+	return fmt.Errorf("Rejected by the server: %s: %w", message.Body, err)
+}
+
+// Returns a channel of the chat messages read from chat server, control and system messages go to Control instead.
+// The first call to Messages or Control starts reading in the background, the client must be registered by then
+// and Read, ReadJSON and the other reads must not be used any more. Both channels close when the connection fails.
+// Both have to be drained, a full one holds up the other. Only JSONProtocol tells the two kinds apart,
+// with TextProtocol every frame is a chat message.
+func (c *ChatClient) Messages() <-chan Message {
+	c.startDemux()
+	return c.messages
+}
+
+// Returns a channel of the messages read from chat server that are not chat messages, such as errors,
+// system and maintenance notices. See Messages.
+func (c *ChatClient) Control() <-chan Message {
+	c.startDemux()
+	return c.control
+}
+
+// Starts the reader goroutine behind Messages and Control, once.
+func (c *ChatClient) startDemux() {
+	c.demuxOnce.Do(func() {
+		c.messages = make(chan Message, clientChannelBuffer)
+		c.control = make(chan Message, clientChannelBuffer)
+		go c.demux()
+	})
+}
+
+// A blocking function that reads from chat server until the connection fails, passing chat messages to Messages
+// and the rest to Control, then closes both.
+func (c *ChatClient) demux() {
+	defer close(c.messages)
+	defer close(c.control)
+	for {
+		message, _, err := c.ReadAny()
+		if err != nil {
+			// A rejection is the last message, it still goes to Control.
+			if message.Type != "" {
+				c.control <- message
+			}
+			return
+		}
+		if message.Type == MessageTypeChat {
+			c.messages <- message
+		} else {
+			c.control <- message
+		}
+	}
+}
+
+// Records the delivery sequence number of a message read from the server, counting the messages skipped before it.
+func (c *ChatClient) trackDelivery(message Message) {
+	if message.DeliverySeq == 0 {
+		return
+	}
+	last := c.lastDeliverySeq.Swap(message.DeliverySeq)
+	if message.DeliverySeq > last+1 {
+		c.missed.Add(message.DeliverySeq - last - 1)
+	}
+}
+
+// Returns the delivery sequence number of the last message read from chat server with ReadJSON or WaitFor.
+func (c *ChatClient) LastDeliverySeq() uint64 {
+	return c.lastDeliverySeq.Load()
+}
+
+// Returns how many messages the server delivered that the client never read, detected from gaps in the
+// delivery sequence numbers. Messages dropped on the way can not be recovered.
+func (c *ChatClient) MissedMessages() uint64 {
+	return c.missed.Load()
+}
+
+// Read Message envelopes from chat server until one of msgType arrives or ctx is done, the server config must use JSONProtocol.
+// Messages of other types are kept and returned by the following ReadJSON calls in order.
+func (c *ChatClient) WaitFor(ctx context.Context, msgType string) (message Message, err error) {
+	for i, message := range c.pending {
+		if message.Type == msgType {
+			c.pending = append(c.pending[:i:i], c.pending[i+1:]...)
+			return message, nil
+		}
+	}
+	ws, err := c.checkConnected()
+	if err != nil {
+		return Message{}, err
+	}
+	// Unblock the read once ctx is done, and clear the deadline again before returning.
+	expired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		ws.SetReadDeadline(time.Now())
+		close(expired)
+	})
+	defer func() {
+		if !stop() {
+			<-expired
+			ws.SetReadDeadline(time.Time{})
+		}
+	}()
+	for {
+		if err := wsCodec(c.Codec).Receive(ws, &message); err != nil {
+			if ctx.Err() != nil {
+				return Message{}, fmt.Errorf("No %s message from server: %v", msgType, ctx.Err())
+			}
+			if !errors.Is(err, ErrBadFrame) {
+				c.connected.Store(false)
+			}
+			log.Println("Can not receive message from server:", err)
+			return Message{}, fmt.Errorf("Can not receive message from server: %v", err)
+		}
+		c.trackDelivery(message)
+		if message.Type == msgType {
+			return message, nil
+		}
+		if err := c.rejected(message); err != nil {
+			return message, err
+		}
+		c.pending = append(c.pending, message)
+		message = Message{}
+	}
+}
+
+// Marshal v into JSON and send it to chat server, ensure you have registered with the server.
+func (c *ChatClient) SendValue(v any) (err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Can not marshal value to JSON:", err)
+		return fmt.Errorf("Can not marshal value to JSON: %v", err)
+	}
+	return c.Send(string(data))
+}
+
+// Read the message from chat server and unmarshal it from JSON into dst, ensure you have registered with the server.
+func (c *ChatClient) ReadValue(dst any) (err error) {
+	message, err := c.Read()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(message), dst); err != nil {
+		log.Println("Can not unmarshal message from JSON:", err)
+		return fmt.Errorf("Can not unmarshal message from JSON: %v", err)
+	}
+	return nil
+}
+
+// Returns the connection established by the latest Register.
+func (c *ChatClient) activeConn() *websocket.Conn {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn
+}
+
 // TODO: Maybe user can determine how oftn to sends a heartbeat message.
-// A blocking function that continuously sends a heartbeat message to the server every 60 seconds.
-func keepWebsocketAlive(ws *websocket.Conn) {
+// A blocking function that continuously sends a heartbeat message to the server every 60 seconds,
+// varied by HeartbeatJitter.
+// It stops once a later Register replaced ws, the new connection has its own heartbeat.
+// If the heartbeat fails, the client is marked as disconnected and OnHeartbeatFailure is called.
+func (c *ChatClient) keepWebsocketAlive(ws *websocket.Conn) {
 	defer ws.Close()
+	interval := 60 * time.Second
+	wait := interval
+	if c.HeartbeatJitter > 0 {
+		// Offset the first heartbeat so clients connecting together do not stay in step.
+		wait = time.Duration(rand.Int63n(int64(interval)))
+	}
 	for {
-		time.Sleep(60 * time.Second)
-		if err := websocket.Message.Send(ws, "heartbeat"); err != nil {
+		<-clockOrReal(c.Clock).After(wait)
+		wait = jitter(interval, c.HeartbeatJitter)
+		if c.activeConn() != ws {
+			return
+		}
+		var err error
+		if c.chatServer.protocol == JSONProtocol {
+			err = wsCodec(c.Codec).Send(ws, Message{Type: MessageTypeHeartbeat})
+		} else {
+			err = websocket.Message.Send(ws, textHeartbeat)
+		}
+		if err != nil {
 			log.Println("Can not send heartbeat to server:", err)
+			// A failure on a connection that has just been replaced says nothing about the new one.
+			if c.activeConn() == ws {
+				c.connected.Store(false)
+				if c.OnHeartbeatFailure != nil {
+					c.OnHeartbeatFailure(err)
+				}
+			}
 			return
 		}
 	}
 }
+
+// Returns d randomly varied by up to ±fraction of itself.
+// fraction is capped at maxHeartbeatJitter.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	if fraction > maxHeartbeatJitter {
+		fraction = maxHeartbeatJitter
+	}
+	return d + time.Duration(float64(d)*fraction*(2*rand.Float64()-1))
+}
@@ -0,0 +1,501 @@
+package chatroom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestFailFastStopsUsingADeadConnection(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	c := connect(t, url, "", "", func(c *ChatClient) { c.FailFast = true })
+	waitConns(t, s, 1)
+
+	s.stopPool()
+	if _, err := c.Read(); err == nil {
+		t.Fatal("Read succeeded on a closed connection")
+	}
+	if err := c.Send("hello"); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Send returned %v, want ErrNotConnected", err)
+	}
+	if _, err := c.Read(); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Read returned %v, want ErrNotConnected", err)
+	}
+}
+
+func TestSendValueAndReadValue(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	sender := connect(t, url, "", "", nil)
+	receiver := connect(t, url, "", "", nil)
+	waitConns(t, s, 2)
+
+	type point struct {
+		X, Y int
+	}
+	if err := sender.SendValue(point{X: 1, Y: 2}); err != nil {
+		t.Fatal(err)
+	}
+	var got point
+	if err := receiver.ReadValue(&got); err != nil || got != (point{X: 1, Y: 2}) {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	if err := sender.Send("not json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.ReadValue(&got); err == nil {
+		t.Fatal("ReadValue decoded a message that is not JSON")
+	}
+	if err := sender.SendValue(func() {}); err == nil {
+		t.Fatal("SendValue encoded a value JSON can not represent")
+	}
+}
+
+func TestJitterSpreadsIntervals(t *testing.T) {
+	base := 60 * time.Second
+	low, high := base, base
+	for i := 0; i < 1000; i++ {
+		d := jitter(base, 0.1)
+		if d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("jitter %v is outside ±10%%", d)
+		}
+		low, high = min(low, d), max(high, d)
+	}
+	if high-low < 6*time.Second {
+		t.Fatalf("jittered intervals are clustered between %v and %v", low, high)
+	}
+	if d := jitter(base, 0); d != base {
+		t.Fatalf("zero jitter changed the interval to %v", d)
+	}
+	for i := 0; i < 1000; i++ {
+		if d := jitter(base, 5); d < 6*time.Second {
+			t.Fatalf("an oversized jitter shrank the interval to %v", d)
+		}
+	}
+}
+
+func TestFirstHeartbeatsAreOffset(t *testing.T) {
+	s := newTestServer("")
+	serverClock := newFakeClock()
+	s.Clock = serverClock
+	url := startServer(t, s)
+	clock := newFakeClock()
+	const clients = 20
+	for i := 0; i < clients; i++ {
+		connect(t, url, "", "", func(c *ChatClient) {
+			c.HeartbeatJitter = 0.1
+			c.Clock = clock
+		})
+	}
+	waitUntil(t, func() bool { return clock.Waiting() == clients })
+
+	clock.mu.Lock()
+	first, last := clock.waiters[0].at, clock.waiters[0].at
+	for _, w := range clock.waiters {
+		if w.at.Before(first) {
+			first = w.at
+		}
+		if w.at.After(last) {
+			last = w.at
+		}
+	}
+	clock.mu.Unlock()
+	if last.Sub(first) < 10*time.Second {
+		t.Fatalf("first heartbeats of %d clients are clustered within %v", clients, last.Sub(first))
+	}
+
+	// The client whose offset is up sends its heartbeat then, not an interval later.
+	// The server stamps it with its own clock, moved on so it tells heartbeats from registrations.
+	serverClock.Advance(time.Second)
+	clock.Advance(first.Sub(clock.Now()))
+	waitUntil(t, func() bool {
+		heartbeats := 0
+		for _, conn := range s.serverConnPool.snapshot() {
+			if conn.lastActivity.Load() == serverClock.Now().UnixNano() {
+				heartbeats++
+			}
+		}
+		return heartbeats == 1
+	})
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	sc, err := NewServerConfig("http://localhost/", "", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChatClient("", sc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.WaitUntilReady(ctx); err == nil {
+		t.Fatal("an unregistered client is ready")
+	}
+
+	ready := make(chan error, 1)
+	go func() { ready <- c.WaitUntilReady(context.Background()) }()
+	c.Register("")
+	t.Cleanup(func() { c.activeConn().Close() })
+	if err := <-ready; err != nil {
+		t.Fatalf("WaitUntilReady after Register: %v", err)
+	}
+
+	waitConns(t, s, 1)
+	s.stopPool()
+	c.Read()
+	if err := c.WaitUntilReady(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("WaitUntilReady on a lost connection returned %v", err)
+	}
+}
+
+func TestUnregisteredClientIsNotConnected(t *testing.T) {
+	sc, err := NewServerConfig("http://localhost/", "", "ws://127.0.0.1:1/register")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChatClient("", sc)
+	if err := c.Send("hello"); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Send returned %v", err)
+	}
+	if _, err := c.Read(); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Read returned %v", err)
+	}
+	if err := c.SendJSON(Message{Body: "hello"}); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("SendJSON returned %v", err)
+	}
+	if _, err := c.ReadJSON(); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("ReadJSON returned %v", err)
+	}
+}
+
+func TestWaitForKeepsOtherMessages(t *testing.T) {
+	s := newTestServer("")
+	ids := make(chan string, 1)
+	s.OnConnect = func(ctx *ConnContext) { ids <- ctx.ID }
+	url := startServer(t, s)
+	c := connect(t, url, JSONProtocol, "", nil)
+	id := <-ids
+	waitConns(t, s, 1)
+
+	s.Broadcast("one")
+	s.Broadcast("two")
+	if err := s.Push(id, Message{Type: "ack", Body: "done"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Broadcast("three")
+	message, err := c.WaitFor(context.Background(), "ack")
+	if err != nil || message.Type != "ack" || message.Body != "done" {
+		t.Fatalf("WaitFor returned %+v, %v", message, err)
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		if message, err := c.ReadJSON(); err != nil || message.Body != want {
+			t.Fatalf("got %+v, %v, want %q", message, err, want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.WaitFor(ctx, "ack"); err == nil {
+		t.Fatal("WaitFor returned without an ack")
+	}
+	// The expired wait leaves the connection usable.
+	s.Broadcast("four")
+	if message, err := c.ReadJSON(); err != nil || message.Body != "four" {
+		t.Fatalf("got %+v, %v after the expired wait", message, err)
+	}
+}
+
+func TestHeartbeatFollowsReconnect(t *testing.T) {
+	// The server records what each connection receives, prefixed with the connection's number.
+	frames := make(chan string, 16)
+	var conns atomic.Int32
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		n := conns.Add(1)
+		for {
+			var frame string
+			if err := websocket.Message.Receive(ws, &frame); err != nil {
+				frames <- fmt.Sprint(n, " closed")
+				return
+			}
+			frames <- fmt.Sprint(n, " ", frame)
+		}
+	}))
+	defer server.Close()
+	sc, err := NewServerConfig("http://localhost/", "", "ws"+strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	c := NewChatClient("", sc)
+	c.Clock = clock
+	c.Register("")
+	waitUntil(t, func() bool { return clock.Waiting() == 1 })
+	c.Register("")
+	defer c.activeConn().Close()
+	if frame := <-frames; frame != "1 closed" {
+		t.Fatalf("got %q, want the first connection closed", frame)
+	}
+
+	waitUntil(t, func() bool { return clock.Waiting() == 2 })
+	clock.Advance(60 * time.Second)
+	if frame := <-frames; frame != "2 "+textHeartbeat {
+		t.Fatalf("got %q, want a heartbeat on the second connection", frame)
+	}
+	select {
+	case frame := <-frames:
+		t.Fatalf("unexpected %q", frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientDetectsMissedMessages(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	c := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 1)
+
+	s.Broadcast("one")
+	if message, err := c.ReadJSON(); err != nil || c.LastDeliverySeq() != 1 || c.MissedMessages() != 0 {
+		t.Fatalf("got %+v, %v, last %d, missed %d", message, err, c.LastDeliverySeq(), c.MissedMessages())
+	}
+	// Pretend a message got lost on the way.
+	conn := s.serverConnPool.snapshot()[0]
+	conn.sendMu.Lock()
+	conn.delivered++
+	conn.sendMu.Unlock()
+	s.Broadcast("two")
+	if message, err := c.ReadJSON(); err != nil || message.Body != "two" || c.LastDeliverySeq() != 3 || c.MissedMessages() != 1 {
+		t.Fatalf("got %+v, %v, last %d, missed %d", message, err, c.LastDeliverySeq(), c.MissedMessages())
+	}
+}
+
+func TestNewServerConfigFromURL(t *testing.T) {
+	for _, tc := range []struct {
+		url, origin string
+	}{
+		{"ws://localhost:8080/register", "http://localhost:8080"},
+		{"wss://chat.example.com/register", "https://chat.example.com"},
+	} {
+		sc, err := NewServerConfigFromURL(tc.url)
+		if err != nil || sc.origin != tc.origin || sc.protocol != "" || sc.url_.String() != tc.url {
+			t.Fatalf("%s: got %+v, %v", tc.url, sc, err)
+		}
+	}
+	for _, url := range []string{"http://localhost:8080/register", "localhost:8080", "ws:///register", "ws://%zz"} {
+		if _, err := NewServerConfigFromURL(url); err == nil {
+			t.Fatalf("%s was accepted", url)
+		}
+	}
+
+	s := newTestServer("")
+	url := startServer(t, s)
+	sc, err := NewServerConfigFromURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChatClient("", sc)
+	c.Register("")
+	defer c.activeConn().Close()
+	waitConns(t, s, 1)
+}
+
+func TestOnHeartbeatFailure(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	clock := newFakeClock()
+	failures := make(chan error, 1)
+	c := connect(t, url, "", "", func(c *ChatClient) {
+		c.Clock = clock
+		c.OnHeartbeatFailure = func(err error) { failures <- err }
+	})
+	waitUntil(t, func() bool { return clock.Waiting() == 1 })
+
+	c.activeConn().Close()
+	clock.Advance(60 * time.Second)
+	select {
+	case err := <-failures:
+		if err == nil {
+			t.Fatal("OnHeartbeatFailure got a nil error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnHeartbeatFailure was not called")
+	}
+	if err := c.WaitUntilReady(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("WaitUntilReady returned %v after the heartbeat failed", err)
+	}
+}
+
+func TestReconnectFromOnHeartbeatFailure(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	clock := newFakeClock()
+	reconnected := make(chan error, 1)
+	var c *ChatClient
+	c = connect(t, url, JSONProtocol, "", func(c *ChatClient) {
+		c.Clock = clock
+		c.OnHeartbeatFailure = func(error) { reconnected <- c.Reconnect("") }
+	})
+	waitUntil(t, func() bool { return clock.Waiting() == 1 })
+
+	c.activeConn().Close()
+	clock.Advance(60 * time.Second)
+	if err := <-reconnected; err != nil {
+		t.Fatalf("Reconnect: %v", err)
+	}
+	waitConns(t, s, 1)
+	s.Broadcast("after reconnect")
+	readBody(t, c, "after reconnect")
+}
+
+func TestReconnectReturnsDialErrors(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	c := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 1)
+	sc, err := NewServerConfig("http://localhost/", JSONProtocol, "ws://127.0.0.1:1/register")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.chatServer = sc
+	if err := c.Reconnect(""); err == nil {
+		t.Fatal("Reconnect to a closed port succeeded")
+	}
+	// The connection it had is kept.
+	s.Broadcast("still connected")
+	readBody(t, c, "still connected")
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		origin, protocol, url string
+		want                  string
+	}{
+		{"http://localhost/", JSONProtocol, "ws://localhost:8080/register", ""},
+		{"https://chat.example.com", "", "wss://chat.example.com/register", ""},
+		{"http://localhost/", "", "http://localhost:8080/register", "must use ws or wss"},
+		{"http://localhost/", "", "ws:///register", "has no host"},
+		{"localhost", "", "ws://localhost:8080/register", "absolute url"},
+		{"http://%zz", "", "ws://localhost:8080/register", "not a valid url"},
+		{"http://localhost/", "chat json", "ws://localhost:8080/register", "not a valid subprotocol"},
+		{"http://localhost/", "chat/json", "ws://localhost:8080/register", "not a valid subprotocol"},
+	} {
+		sc, err := NewServerConfig(tc.origin, tc.protocol, tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sc.Validate()
+		if tc.want == "" && err != nil {
+			t.Fatalf("%s %q %s: %v", tc.origin, tc.protocol, tc.url, err)
+		}
+		if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Fatalf("%s %q %s: got %v, want an error saying %q", tc.origin, tc.protocol, tc.url, err, tc.want)
+		}
+	}
+}
+
+func TestReadAny(t *testing.T) {
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		wsCodec(nil).Send(ws, Message{Type: MessageTypeSystem, Body: "structured", Seq: 7})
+		websocket.Message.Send(ws, "plain text")
+		websocket.Message.Send(ws, `{"not":"an envelope"}`)
+		websocket.Message.Send(ws, []byte{0xff, 0x00})
+		// Wait for the client to hang up.
+		var frame string
+		websocket.Message.Receive(ws, &frame)
+	}))
+	defer server.Close()
+	sc, err := NewServerConfigFromURL("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChatClient("", sc)
+	c.Register("")
+	defer c.activeConn().Close()
+
+	for _, want := range []struct {
+		message    Message
+		structured bool
+	}{
+		{Message{Type: MessageTypeSystem, Body: "structured", Seq: 7}, true},
+		{Message{Type: MessageTypeChat, Body: "plain text"}, false},
+		{Message{Type: MessageTypeChat, Body: `{"not":"an envelope"}`}, false},
+		{Message{Type: MessageTypeChat, Body: "\xff\x00", Binary: true}, false},
+	} {
+		message, structured, err := c.ReadAny()
+		if err != nil || message != want.message || structured != want.structured {
+			t.Fatalf("got %+v, %v, %v, want %+v, %v", message, structured, err, want.message, want.structured)
+		}
+	}
+}
+
+func TestMessagesAndControlAreSeparate(t *testing.T) {
+	s := newTestServer("")
+	s.WelcomeBanner = "welcome"
+	s.DuplicateLimit = 1
+	url := startServer(t, s)
+	c := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 1)
+	sender := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 2)
+	messages, control := c.Messages(), c.Control()
+
+	sender.SendJSON(Message{Body: "hi"})
+	c.SendJSON(Message{Body: "twice"})
+	c.SendJSON(Message{Body: "twice"})
+	if message := <-messages; message.Body != "hi" {
+		t.Fatalf("Messages got %+v", message)
+	}
+	if message := <-control; message.Type != MessageTypeSystem || message.Body != "welcome" {
+		t.Fatalf("Control got %+v, want the banner", message)
+	}
+	if message := <-control; message.Type != MessageTypeError || message.Reason != ReasonDuplicate {
+		t.Fatalf("Control got %+v, want the duplicate error", message)
+	}
+
+	if err := s.Stop(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	for message := range messages {
+		t.Fatalf("Messages got %+v after the chat messages", message)
+	}
+	for message := range control {
+		t.Fatalf("Control got %+v after the control messages", message)
+	}
+}
+
+func TestRejectionsAreTypedErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		password string
+		setup    func(s *ChatServer)
+		want     error
+	}{
+		{"incorrect password", "wrong", func(s *ChatServer) {}, ErrInvalidPassword},
+		{"server full", "secret", func(s *ChatServer) { s.SetMaxConnections(1) }, ErrServerFull},
+		{"maintenance", "secret", func(s *ChatServer) { s.SetAcceptingConnections(false) }, ErrMaintenance},
+	} {
+		s := newTestServer("secret")
+		url := startServer(t, s)
+		connect(t, url, JSONProtocol, "secret", nil)
+		waitConns(t, s, 1)
+		tc.setup(s)
+
+		c := connect(t, url, JSONProtocol, tc.password, nil)
+		if _, err := c.ReadJSON(); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: ReadJSON returned %v, want %v", tc.name, err, tc.want)
+		}
+		if err := c.WaitUntilReady(context.Background()); !errors.Is(err, ErrNotConnected) {
+			t.Fatalf("%s: the client still counts as connected", tc.name)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package chatroom
+
+import "time"
+
+// Clock is the source of time for the chat server and client.
+// Timestamps, windows and waits go through it, so tests can inject a fake clock and advance time
+// without sleeping. Network read and write deadlines still use the real clock, the OS enforces them.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// A realClock is the default Clock, backed by the time package.
+type realClock struct{}
+
+// Returns the current time.
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Returns a channel that receives the current time after d.
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Returns clock, or the real clock if it is nil.
+func clockOrReal(clock Clock) Clock {
+	if clock == nil {
+		return realClock{}
+	}
+	return clock
+}
@@ -0,0 +1,125 @@
+package chatroom
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fakeClock only moves when the test advances it.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// A fakeWaiter is a pending After.
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Moves the clock forward by d and fires the waits that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = pending
+}
+
+// Sets the clock to t without firing any wait, t may be in the past.
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// Returns the number of pending waits, so a test can wait for a goroutine to start waiting.
+func (c *fakeClock) Waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func TestServerTimeFollowsClock(t *testing.T) {
+	s := newTestServer("")
+	clock := newFakeClock()
+	s.Clock = clock
+	s.DrainGracePeriod = time.Minute
+	url := startServer(t, s)
+	if !s.StartedAt().Equal(clock.Now()) {
+		t.Fatalf("StartedAt %v is not the clock's time %v", s.StartedAt(), clock.Now())
+	}
+	clock.Advance(time.Hour)
+	if uptime := s.Uptime(); uptime != time.Hour {
+		t.Fatalf("Uptime %v, want 1h", uptime)
+	}
+
+	c := connect(t, url, "", "", nil)
+	waitConns(t, s, 1)
+	done := make(chan error, 1)
+	go func() { done <- s.DrainAndStop(context.Background(), "bye") }()
+	c.Read()
+	// The throughput sampler, the grace period and the poll are all waiting on the clock.
+	waitUntil(t, func() bool { return clock.Waiting() == 3 })
+	select {
+	case <-done:
+		t.Fatal("DrainAndStop returned before the grace period passed on the clock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Minute)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeqStaysOrderedWhenTheClockGoesBack(t *testing.T) {
+	s := newTestServer("")
+	clock := newFakeClock()
+	s.Clock = clock
+	client := servePipe(t, s)
+	waitConns(t, s, 1)
+
+	go s.Broadcast("before")
+	before := receive(t, client)
+	clock.Set(clock.Now().Add(-time.Hour))
+	go s.Broadcast("after")
+	after := receive(t, client)
+	if before.Time != clock.Now().Add(time.Hour).UnixMilli() || after.Time != clock.Now().UnixMilli() {
+		t.Fatalf("times %d and %d are not the clock's", before.Time, after.Time)
+	}
+	if after.Seq <= before.Seq {
+		t.Fatalf("seq went from %d to %d when the clock went back", before.Seq, after.Seq)
+	}
+}
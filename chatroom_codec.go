@@ -0,0 +1,76 @@
+package chatroom
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/net/websocket"
+)
+
+// Codec encodes the Message envelopes exchanged with JSONProtocol connections.
+// JSONCodec is used by default. To use another format such as protobuf or msgpack, implement Codec
+// and set the same codec on both ChatServer.Codec and ChatClient.Codec.
+// Encoded messages that are valid UTF-8 are sent as text frames, anything else as binary frames.
+type Codec interface {
+	Marshal(message Message) ([]byte, error)
+	Unmarshal(data []byte, message *Message) error
+}
+
+// JSONCodec encodes messages as JSON, it is the default Codec.
+// The Body of a Binary message is base64-encoded, since JSON strings can only hold valid UTF-8.
+var JSONCodec Codec = jsonCodec{}
+
+// A jsonCodec is the Codec behind JSONCodec.
+type jsonCodec struct{}
+
+// Encodes the message as JSON.
+func (jsonCodec) Marshal(message Message) ([]byte, error) {
+	if message.Binary {
+		message.Body = base64.StdEncoding.EncodeToString([]byte(message.Body))
+	}
+	return json.Marshal(message)
+}
+
+// Decodes the message from JSON.
+func (jsonCodec) Unmarshal(data []byte, message *Message) error {
+	if err := json.Unmarshal(data, message); err != nil {
+		return err
+	}
+	if message.Binary {
+		body, err := base64.StdEncoding.DecodeString(message.Body)
+		if err != nil {
+			return err
+		}
+		message.Body = string(body)
+	}
+	return nil
+}
+
+// Adapts a Codec to a websocket.Codec sending and receiving Message values.
+// A nil codec means JSONCodec.
+func wsCodec(codec Codec) websocket.Codec {
+	if codec == nil {
+		codec = JSONCodec
+	}
+	return websocket.Codec{
+		Marshal: func(v interface{}) ([]byte, byte, error) {
+			data, err := codec.Marshal(v.(Message))
+			if err != nil {
+				return nil, 0, err
+			}
+			if utf8.Valid(data) {
+				return data, websocket.TextFrame, nil
+			}
+			return data, websocket.BinaryFrame, nil
+		},
+		Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+			// The frame has been fully read, so the connection is still usable.
+			if err := codec.Unmarshal(data, v.(*Message)); err != nil {
+				return fmt.Errorf("%w: %v", ErrBadFrame, err)
+			}
+			return nil
+		},
+	}
+}
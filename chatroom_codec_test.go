@@ -0,0 +1,57 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// A prefixCodec is JSON behind a byte that is not valid UTF-8, so it travels in binary frames.
+type prefixCodec struct{}
+
+func (prefixCodec) Marshal(message Message) ([]byte, error) {
+	data, err := json.Marshal(message)
+	return append([]byte{0xff}, data...), err
+}
+
+func (prefixCodec) Unmarshal(data []byte, message *Message) error {
+	if len(data) == 0 || data[0] != 0xff {
+		return errors.New("missing prefix")
+	}
+	return json.Unmarshal(data[1:], message)
+}
+
+func TestCustomCodecRoundTrip(t *testing.T) {
+	s := newTestServer("")
+	s.Codec = prefixCodec{}
+	url := startServer(t, s)
+	setup := func(c *ChatClient) { c.Codec = prefixCodec{} }
+	sender := connect(t, url, JSONProtocol, "", setup)
+	receiver := connect(t, url, JSONProtocol, "", setup)
+	waitConns(t, s, 2)
+
+	if err := sender.SendJSON(Message{Body: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	message, err := receiver.ReadJSON()
+	if err != nil || message.Type != MessageTypeChat || message.Body != "hello" {
+		t.Fatalf("got %+v, %v", message, err)
+	}
+}
+
+func TestWSCodecFrameTypes(t *testing.T) {
+	data, payloadType, err := wsCodec(nil).Marshal(Message{Type: MessageTypeChat, Body: "hi"})
+	if err != nil || payloadType != websocket.TextFrame {
+		t.Fatalf("JSONCodec sent %q as frame type %d, %v", data, payloadType, err)
+	}
+	_, payloadType, err = wsCodec(prefixCodec{}).Marshal(Message{Type: MessageTypeChat, Body: "hi"})
+	if err != nil || payloadType != websocket.BinaryFrame {
+		t.Fatalf("invalid UTF-8 sent as frame type %d, %v", payloadType, err)
+	}
+	var message Message
+	if err := wsCodec(nil).Unmarshal([]byte("not json"), websocket.TextFrame, &message); !errors.Is(err, ErrBadFrame) {
+		t.Fatalf("decoding garbage returned %v, want ErrBadFrame", err)
+	}
+}
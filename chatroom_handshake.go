@@ -0,0 +1,84 @@
+package chatroom
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// The request context key holding the function that releases a handshake slot.
+type handshakeReleaseKey struct{}
+
+// Wraps the WebSocket handler so at most MaxConcurrentHandshakes connections are in their handshake at once.
+// A connection holds its slot until registerServer has authenticated it, excess connections are
+// rejected with 503 Service Unavailable.
+func (s *ChatServer) limitHandshakes(next http.Handler) http.Handler {
+	slots := make(chan struct{}, s.MaxConcurrentHandshakes)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			s.logger.Println(r.RemoteAddr, "Client connection failed: Too many handshakes in progress.")
+			http.Error(w, "Too many handshakes in progress", http.StatusServiceUnavailable)
+			return
+		}
+		var once sync.Once
+		release := func() { once.Do(func() { <-slots }) }
+		// The WebSocket handler keeps running for the whole connection, release in case it never authenticates.
+		defer release()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), handshakeReleaseKey{}, release)))
+	})
+}
+
+// Releases the handshake slot held by the request, if the handshake limiter is enabled.
+func releaseHandshake(r *http.Request) {
+	if release, ok := r.Context().Value(handshakeReleaseKey{}).(func()); ok {
+		release()
+	}
+}
+
+// A handshakeTracker holds the accepted connections that are still in their HTTP handshake,
+// from when they are accepted until they become WebSocket connections, go idle or close.
+type handshakeTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// Follows the state changes of the HTTP server's connections, it is the server's ConnState hook.
+func (h *handshakeTracker) connState(c net.Conn, state http.ConnState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		if h.conns == nil {
+			h.conns = make(map[net.Conn]struct{})
+		}
+		h.conns[c] = struct{}{}
+	case http.StateActive:
+	default:
+		delete(h.conns, c)
+	}
+}
+
+// Returns the number of connections still in their handshake. Plain HTTP requests, such as to StatsPath,
+// count while they are being served.
+func (s *ChatServer) PendingHandshakes() int {
+	s.handshakes.mu.Lock()
+	defer s.handshakes.mu.Unlock()
+	return len(s.handshakes.conns)
+}
+
+// Closes every connection still in its handshake, for example one stuck sending its request,
+// and returns how many were closed. Registered connections are left intact.
+func (s *ChatServer) CancelHandshakes() int {
+	s.handshakes.mu.Lock()
+	conns := s.handshakes.conns
+	s.handshakes.conns = nil
+	s.handshakes.mu.Unlock()
+	for c := range conns {
+		s.logger.Println(c.RemoteAddr(), "Client connection canceled during the handshake.")
+		c.Close()
+	}
+	return len(conns)
+}
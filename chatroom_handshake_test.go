@@ -0,0 +1,97 @@
+package chatroom
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandshakesAreLimited(t *testing.T) {
+	s := newTestServer("")
+	s.MaxConcurrentHandshakes = 1
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	finish := make(chan struct{})
+	handler := s.limitHandshakes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") == "" {
+			return
+		}
+		entered <- struct{}{}
+		<-release
+		releaseHandshake(r)
+		<-finish
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	slow := make(chan *http.Response, 1)
+	go func() {
+		response, err := http.Get(server.URL + "?slow=1")
+		if err == nil {
+			response.Body.Close()
+		}
+		slow <- response
+	}()
+	<-entered
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("second handshake got %d, want 503", response.StatusCode)
+	}
+
+	// Releasing the slot lets the next handshake in while the first connection is still served.
+	release <- struct{}{}
+	response, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("handshake after release got %d", response.StatusCode)
+	}
+	close(finish)
+	<-slow
+}
+
+func TestCancelHandshakes(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	registered := connect(t, url, "", "", nil)
+	waitConns(t, s, 1)
+
+	var stalled []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", s.listenAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		// The request never ends, so the handshake never completes.
+		c.Write([]byte("GET /register HTTP/1.1\r\nHost: localhost\r\n"))
+		stalled = append(stalled, c)
+	}
+	waitUntil(t, func() bool { return s.PendingHandshakes() == 3 })
+
+	if n := s.CancelHandshakes(); n != 3 {
+		t.Fatalf("canceled %d handshakes, want 3", n)
+	}
+	for _, c := range stalled {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("read from a canceled handshake returned %v, want EOF", err)
+		}
+	}
+	if n := s.PendingHandshakes(); n != 0 {
+		t.Fatalf("%d handshakes pending after the cancel", n)
+	}
+	s.Broadcast("still here")
+	if message, err := registered.Read(); err != nil || message != "still here" {
+		t.Fatalf("registered connection got %q, %v", message, err)
+	}
+}
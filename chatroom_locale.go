@@ -0,0 +1,23 @@
+package chatroom
+
+// Localizer translates the bodies of the messages the server sends on its own, such as errors,
+// maintenance notices and the welcome banner, into the locale a client registered with.
+// Notices the server broadcasts, such as a rename, are translated for each recipient.
+// Messages from clients and chat broadcast with ChatServer.Broadcast are never passed to it.
+type Localizer interface {
+	// Localize returns the body of message in locale. The message carries the English body along with
+	// its Type and Reason to tell which one it is. Returning "" keeps the English body.
+	Localize(locale string, message Message) string
+}
+
+// Returns the message with its body translated into locale by the server's Localizer.
+// The message is unchanged if there is no Localizer, no locale or no translation.
+func (s *ChatServer) localize(locale string, message Message) Message {
+	if s.Localizer == nil || locale == "" {
+		return message
+	}
+	if body := s.Localizer.Localize(locale, message); body != "" {
+		message.Body = body
+	}
+	return message
+}
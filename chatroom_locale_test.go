@@ -0,0 +1,69 @@
+package chatroom
+
+import "testing"
+
+// A mapLocalizer translates the English bodies it knows, per locale.
+type mapLocalizer map[string]map[string]string
+
+func (l mapLocalizer) Localize(locale string, message Message) string {
+	return l[locale][message.Body]
+}
+
+func TestServerMessagesAreLocalized(t *testing.T) {
+	s := newTestServer("")
+	s.Localizer = mapLocalizer{
+		"fr": {"Listeners can not send messages.": "Les auditeurs ne peuvent pas envoyer de messages.", "hello": "bonjour"},
+		"de": {"Listeners can not send messages.": "Zuhörer können keine Nachrichten senden.", "hello": "hallo"},
+	}
+	url := startServer(t, s)
+	listener := func(locale string) func(*ChatClient) {
+		return func(c *ChatClient) {
+			c.Listener = true
+			c.Locale = locale
+		}
+	}
+	fr := connect(t, url, JSONProtocol, "", listener("fr"))
+	de := connect(t, url, "", "", listener("de"))
+	en := connect(t, url, JSONProtocol, "", listener(""))
+	waitConns(t, s, 3)
+
+	fr.SendJSON(Message{Body: "hi"})
+	if message, err := fr.ReadJSON(); err != nil || message.Body != "Les auditeurs ne peuvent pas envoyer de messages." {
+		t.Fatalf("fr got %+v, %v", message, err)
+	}
+	de.Send("hi")
+	if message, err := de.Read(); err != nil || message != "Zuhörer können keine Nachrichten senden." {
+		t.Fatalf("de got %q, %v", message, err)
+	}
+	en.SendJSON(Message{Body: "hi"})
+	if message, err := en.ReadJSON(); err != nil || message.Body != "Listeners can not send messages." {
+		t.Fatalf("a client without a locale got %+v, %v", message, err)
+	}
+
+	// Chat content is not the server's own, it is never translated.
+	s.Broadcast("hello")
+	if message, err := fr.ReadJSON(); err != nil || message.Body != "hello" {
+		t.Fatalf("fr got %+v, %v", message, err)
+	}
+	if message, err := de.Read(); err != nil || message != "hello" {
+		t.Fatalf("de got %q, %v", message, err)
+	}
+}
+
+func TestBroadcastNoticesAreLocalizedPerRecipient(t *testing.T) {
+	s := newTestServer("")
+	s.Localizer = mapLocalizer{"fr": {"guest is now known as alice.": "guest s'appelle désormais alice."}}
+	url := startServer(t, s)
+	guest := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.ClientID = "guest" })
+	waitConns(t, s, 1)
+	fr := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.Locale = "fr" })
+	waitConns(t, s, 2)
+
+	guest.SendJSON(Message{Type: MessageTypeClaimID, ID: "alice"})
+	if message, err := guest.ReadJSON(); err != nil || message.Body != "guest is now known as alice." {
+		t.Fatalf("a client without a locale got %+v, %v", message, err)
+	}
+	if message, err := fr.ReadJSON(); err != nil || message.Type != MessageTypeSystem || message.Body != "guest s'appelle désormais alice." {
+		t.Fatalf("fr got %+v, %v", message, err)
+	}
+}
@@ -0,0 +1,93 @@
+package chatroom
+
+// WebSocket subprotocols used to negotiate the wire format with the chat server.
+// A client offering TextProtocol, or no subprotocol at all, sends and receives raw strings.
+// A client offering JSONProtocol sends and receives Message envelopes encoded by the Codec, JSON by default.
+const (
+	TextProtocol = "chat.text.v1"
+	JSONProtocol = "chat.json.v1"
+)
+
+// Message types carried in the Type field of a Message.
+const (
+	MessageTypeChat        = "message"
+	MessageTypeHeartbeat   = "heartbeat"
+	MessageTypeError       = "error"
+	MessageTypeSystem      = "system"
+	MessageTypeMaintenance = "maintenance"
+	MessageTypeChunk       = "chunk"
+	MessageTypeAck         = "ack"
+	MessageTypeClaimID     = "claim_id"
+)
+
+// Reasons carried in the Reason field of an error Message.
+// ReasonNoClientCert is only reported to ChatServer.OnAuthFailure.
+const (
+	ReasonBadFrame          = "bad_frame"
+	ReasonDuplicate         = "duplicate"
+	ReasonUnknownType       = "unknown_type"
+	ReasonClientIDRequired  = "client_id_required"
+	ReasonInvalidClientID   = "invalid_client_id"
+	ReasonBadChunk          = "bad_chunk"
+	ReasonStreamTooLarge    = "stream_too_large"
+	ReasonStreamTimeout     = "stream_timeout"
+	ReasonBusy              = "busy"
+	ReasonIncorrectPassword = "incorrect_password"
+	ReasonNoClientCert      = "no_client_certificate"
+	ReasonPaused            = "paused"
+	ReasonClientIDTaken     = "client_id_taken"
+	ReasonThrottled         = "throttled"
+	ReasonServerFull        = "server_full"
+	ReasonEvicted           = "evicted"
+	ReasonReservedType      = "reserved_type"
+	ReasonShutdown          = "shutdown"
+)
+
+// Reports whether messages of type t only ever come from the server.
+// Clients can not send them, or they could pass off their own messages as the server's.
+func serverOnlyType(t string) bool {
+	return t == MessageTypeError || t == MessageTypeSystem || t == MessageTypeMaintenance
+}
+
+// The body of the heartbeat message clients using TextProtocol send.
+const textHeartbeat = "heartbeat"
+
+// The role query parameter value that registers a read-only connection.
+const roleListener = "listener"
+
+// Message is the envelope exchanged with clients using JSONProtocol.
+type Message struct {
+	Type string `json:"type"`
+	Body string `json:"body,omitempty"`
+	// Reason is a machine-readable cause for error messages.
+	Reason string `json:"reason,omitempty"`
+	// Seq is assigned by the server to every broadcast message, it increases by one per broadcast
+	// for the lifetime of the server and broadcasts are delivered in Seq order, so clients can order
+	// messages and detect gaps. A sender that did not ask for echo does not receive its own messages,
+	// it sees a gap at each of their Seq.
+	Seq uint64 `json:"seq,omitempty"`
+	// Time is the server's wall clock in Unix milliseconds when the message was broadcast, for display only.
+	// The wall clock can jump backwards, order messages by Seq instead.
+	Time int64 `json:"time,omitempty"`
+	// DeliverySeq counts the messages the server sent to this connection, it increases by one per message,
+	// so a client can tell it missed one. Only JSONProtocol connections see it.
+	// An ack message carries the DeliverySeq of the message it acks.
+	DeliverySeq uint64 `json:"delivery_seq,omitempty"`
+	// FromRole is the role the sender of a broadcast authenticated with, such as RoleAdmin, so clients can
+	// show a badge. The server sets it on every broadcast, overwriting whatever the client sent,
+	// and leaves it empty for messages from the server itself.
+	FromRole string `json:"from_role,omitempty"`
+	// Binary marks a message whose Body holds raw bytes, such as a binary frame from a TextProtocol connection.
+	// The server relays it to TextProtocol recipients as a binary frame, JSONCodec carries the Body base64-encoded.
+	Binary bool `json:"binary,omitempty"`
+	// StreamID, Chunk and Last carry a message split into chunks, see ChatClient.SendChunked.
+	// Each chunk message holds a part of the Body, Chunk is its index from 0 and Last marks the final one.
+	// The server reassembles the chunks of a stream, in any order, and broadcasts the whole message.
+	// Error messages about a stream carry its StreamID.
+	StreamID string `json:"stream_id,omitempty"`
+	Chunk    int    `json:"chunk,omitempty"`
+	Last     bool   `json:"last,omitempty"`
+	// ID is the ClientID a claim_id message asks the server to switch the connection to.
+	// It must not be taken by another connection, the server broadcasts a system notice of the rename.
+	ID string `json:"id,omitempty"`
+}
@@ -0,0 +1,65 @@
+package chatroom
+
+// PausePolicy is what happens to chat messages from users while the chat room is paused.
+type PausePolicy int
+
+const (
+	// PauseReject answers each message with a paused error, the message is not broadcast.
+	PauseReject PausePolicy = iota
+	// PauseQueue holds the messages and broadcasts them in order on Resume.
+	PauseQueue
+)
+
+// A pausedMessage is a chat message held by PauseQueue until Resume.
+type pausedMessage struct {
+	sender  *connection
+	message Message
+}
+
+// Pauses the chat room, for example during an announcement. Chat messages from users are then
+// rejected or queued according to PausePolicy, while messages from admins and the server itself still flow.
+// It is safe to call while the server runs, pausing a paused room does nothing.
+func (s *ChatServer) Pause() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	s.paused = true
+}
+
+// Resumes a paused chat room. Messages queued while it was paused are broadcast first, in the order
+// they arrived, before any message sent after Resume.
+func (s *ChatServer) Resume() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	s.paused = false
+	queued := s.pausedQueue
+	s.pausedQueue = nil
+	// Holding pauseMu while flushing keeps new messages from overtaking the queued ones.
+	for _, held := range queued {
+		s.broadcastFrom(held.sender, held.message)
+	}
+}
+
+// Reports whether the chat room is paused.
+func (s *ChatServer) Paused() bool {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	return s.paused
+}
+
+// Broadcasts a chat message sent by conn, unless the room is paused and conn is not an admin,
+// in which case the message is rejected or queued according to PausePolicy.
+func (s *ChatServer) broadcastUnlessPaused(conn *connection, message Message) {
+	s.pauseMu.Lock()
+	if !s.paused || conn.role == RoleAdmin {
+		s.pauseMu.Unlock()
+		s.broadcastFrom(conn, message)
+		return
+	}
+	if s.PausePolicy == PauseQueue {
+		s.pausedQueue = append(s.pausedQueue, pausedMessage{sender: conn, message: message})
+		s.pauseMu.Unlock()
+		return
+	}
+	s.pauseMu.Unlock()
+	conn.reply(s.localize(conn.locale, Message{Type: MessageTypeError, Body: "The chat room is paused.", Reason: ReasonPaused}))
+}
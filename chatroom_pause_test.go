@@ -0,0 +1,68 @@
+package chatroom
+
+import "testing"
+
+// Starts a server with a user and an admin password and connects a user, an admin and a receiver to it.
+func startPausableServer(t *testing.T, policy PausePolicy) (s *ChatServer, user, admin, receiver *ChatClient) {
+	t.Helper()
+	s = newTestServer("")
+	s.Passwords = map[string]string{"user": RoleUser, "admin": RoleAdmin}
+	s.PausePolicy = policy
+	url := startServer(t, s)
+	user = connect(t, url, JSONProtocol, "user", nil)
+	admin = connect(t, url, JSONProtocol, "admin", nil)
+	receiver = connect(t, url, JSONProtocol, "user", nil)
+	waitConns(t, s, 3)
+	return s, user, admin, receiver
+}
+
+// Reads the next message from c and fails the test unless its body is want.
+func readBody(t *testing.T, c *ChatClient, want string) {
+	t.Helper()
+	if message, err := c.ReadJSON(); err != nil || message.Body != want {
+		t.Fatalf("got %+v, %v, want %q", message, err, want)
+	}
+}
+
+func TestPauseRejectsUserMessages(t *testing.T) {
+	s, user, admin, receiver := startPausableServer(t, PauseReject)
+	s.Pause()
+	if !s.Paused() {
+		t.Fatal("Paused is false after Pause")
+	}
+
+	user.SendJSON(Message{Body: "rejected"})
+	if message, err := user.ReadJSON(); err != nil || message.Type != MessageTypeError || message.Reason != ReasonPaused {
+		t.Fatalf("got %+v, %v, want a paused error", message, err)
+	}
+	// Admins and the server itself still get through.
+	admin.SendJSON(Message{Body: "announcement"})
+	readBody(t, receiver, "announcement")
+	s.Broadcast("from server")
+	readBody(t, receiver, "from server")
+
+	s.Resume()
+	user.SendJSON(Message{Body: "after resume"})
+	readBody(t, receiver, "after resume")
+}
+
+func TestPauseQueuesUserMessagesUntilResume(t *testing.T) {
+	s, user, admin, receiver := startPausableServer(t, PauseQueue)
+	s.Pause()
+
+	user.SendJSON(Message{Body: "one"})
+	user.SendJSON(Message{Body: "two"})
+	waitUntil(t, func() bool {
+		s.pauseMu.Lock()
+		defer s.pauseMu.Unlock()
+		return len(s.pausedQueue) == 2
+	})
+	admin.SendJSON(Message{Body: "announcement"})
+	readBody(t, receiver, "announcement")
+
+	s.Resume()
+	readBody(t, receiver, "one")
+	readBody(t, receiver, "two")
+	user.SendJSON(Message{Body: "three"})
+	readBody(t, receiver, "three")
+}
@@ -1,24 +1,497 @@
 package chatroom
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
 
+// The default time DrainAndStop waits for clients to leave on their own.
+const defaultDrainGracePeriod = 5 * time.Second
+
+// The default number of consecutive bad frames tolerated before a connection is dropped.
+const defaultMaxBadFrames = 3
+
+// The default time a stop-and-wait connection has to ack a message.
+const defaultAckTimeout = 30 * time.Second
+
+// The number of messages a stop-and-wait connection may have waiting for their turn before it is dropped.
+const ackQueueSize = 64
+
+// The default number of times a send that failed with a transient error is retried, and the wait before the first retry.
+const (
+	defaultSendRetries      = 3
+	defaultSendRetryBackoff = 10 * time.Millisecond
+)
+
+// The default window DuplicateLimit applies to.
+const defaultDuplicateWindow = 10 * time.Second
+
+// Errors returned by connPool.add when a connection can not be registered.
+var (
+	errPoolStopped = errors.New("connection pool is stopped")
+	errBacklogFull = errors.New("register backlog is full")
+	// Returned by connPool.claim.
+	errAlreadyClaimed = errors.New("transport is already registered")
+	errPoolFull       = errors.New("connection limit reached")
+	// errAckTimeout drops a stop-and-wait connection that did not ack the previous message in time.
+	errAckTimeout = errors.New("previous message was not acked in time")
+	// errAckQueueFull is returned by a send to a stop-and-wait connection that has ackQueueSize messages waiting.
+	errAckQueueFull = errors.New("too many messages waiting for an ack")
+	// errConnDone stops the writer of a stop-and-wait connection once the connection is no longer served.
+	errConnDone = errors.New("connection is no longer served")
+)
+
+// Roles a connection can be granted by the password it registered with.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// UnknownTypePolicy decides what the server does with a message whose Type it does not recognize.
+type UnknownTypePolicy int
+
+const (
+	// UnknownTypeIgnore drops the message, it is the default.
+	UnknownTypeIgnore UnknownTypePolicy = iota
+	// UnknownTypeError drops the message and answers the sender with an unknown_type error.
+	UnknownTypeError
+	// UnknownTypeBroadcast broadcasts the message unchanged.
+	UnknownTypeBroadcast
+)
+
+// EvictionPolicy decides which connections are evicted when SetMaxConnections lowers the limit.
+type EvictionPolicy int
+
+const (
+	// EvictNewest evicts the connections that joined last, it is the default.
+	EvictNewest EvictionPolicy = iota
+	// EvictIdlest evicts the connections with the oldest LastActivity.
+	EvictIdlest
+)
+
+// TextNoticeFormat decides how error and notice messages are written to TextProtocol connections,
+// which only receive a message's body. JSONProtocol connections always get the whole Message.
+type TextNoticeFormat int
+
+const (
+	// TextNoticeBody sends the body alone, like a chat message, it is the default.
+	TextNoticeBody TextNoticeFormat = iota
+	// TextNoticePrefixed prefixes the body with the Type and Reason in brackets,
+	// such as "[error:duplicate] Stop sending the same message." or "[maintenance] ...".
+	TextNoticePrefixed
+)
+
 // The chatroom server structure.
 type ChatServer struct {
+	// DrainGracePeriod is how long DrainAndStop waits for clients to disconnect on their own
+	// before force-closing them. Zero means defaultDrainGracePeriod.
+	DrainGracePeriod time.Duration
+	// LogPoolChanges enables logging who joined or left the connection pool along with the new pool size.
+	LogPoolChanges bool
+	// PoolLogInterval is the minimum time between two pool change log lines when LogPoolChanges is set,
+	// changes in between are only counted. Zero logs every change.
+	PoolLogInterval time.Duration
+	// WriteTimeout bounds each write to a WebSocket connection, a connection whose write times out
+	// is unregistered. Zero means writes never time out.
+	WriteTimeout time.Duration
+	// SendRetries is how many times a send that failed with a transient error, such as EAGAIN, is retried
+	// before the connection is unregistered. Each retry gets its own WriteTimeout and the wait before it
+	// doubles, starting at 10ms. Zero means defaultSendRetries and a negative value disables retries.
+	SendRetries int
+	// Passwords maps each accepted password to the role it grants, such as RoleUser or RoleAdmin.
+	// When set, it replaces the single password given to NewChatServer.
+	Passwords map[string]string
+	// Codec encodes messages for JSONProtocol connections, nil means JSONCodec.
+	Codec Codec
+	// MaxBadFrames is how many consecutive frames that can not be decoded a connection may send
+	// before it is dropped, each one is answered with a bad_frame error. Zero means defaultMaxBadFrames.
+	MaxBadFrames int
+	// DuplicateLimit is how many times within DuplicateWindow a connection may send the same message,
+	// whether or not other messages come in between. Further copies are not broadcast and the sender is warned.
+	// Zero disables the check.
+	DuplicateLimit int
+	// DuplicateWindow is the period DuplicateLimit counts over, zero means defaultDuplicateWindow.
+	DuplicateWindow time.Duration
+	// MaxStreamBytes bounds the reassembled size of a chunked message, zero means defaultMaxStreamBytes.
+	MaxStreamBytes int
+	// StreamTimeout is how long a chunked message may take to arrive completely, zero means defaultStreamTimeout.
+	// Incomplete messages are dropped and the sender gets a stream_timeout error.
+	StreamTimeout time.Duration
+	// RequireClientID rejects connections that register without a ClientID.
+	RequireClientID bool
+	// ClientIDPattern, when set, rejects connections whose ClientID does not match it.
+	ClientIDPattern *regexp.Regexp
+	// BroadcastWorkers caps how many connections a broadcast writes to at once, so a slow connection
+	// only holds up one worker. Broadcasts still go out one after another in Seq order.
+	// Zero or one writes to one connection at a time, in the order the connections joined.
+	BroadcastWorkers int
+	// MaxBroadcastsPerSec caps the messages from clients broadcast per second across the whole server,
+	// on top of any per-client limit, to protect whatever consumes the broadcasts. Up to BroadcastBurst
+	// may go out at once, zero means one. Excess messages are handled by ThrottlePolicy and counted by Throttled.
+	// Broadcasts by the server itself are not limited. Zero means no limit.
+	MaxBroadcastsPerSec float64
+	BroadcastBurst      int
+	ThrottlePolicy      ThrottlePolicy
+	// AckTimeout is how long a connection in stop-and-wait mode has to ack a message before the next one,
+	// one that does not ack in time is dropped. Zero means defaultAckTimeout. See ChatClient.StopAndWait.
+	// Broadcasts do not wait for the ack, the messages are queued per connection and one with
+	// ackQueueSize messages waiting is dropped too.
+	AckTimeout time.Duration
+	// RegisterBacklog is how many register events may wait for the ConnPool at once.
+	// When set, a connection arriving while the register backlog is full is rejected with a busy error
+	// instead of waiting. Zero keeps the events unbuffered, every connection waits its turn.
+	// See Backlog for the current depth.
+	RegisterBacklog int
+	// MaxConcurrentHandshakes caps how many connections may be in their handshake and authentication at once,
+	// excess connections are rejected with 503 Service Unavailable. Zero means no limit.
+	MaxConcurrentHandshakes int
+	// ThroughputWindow is the period Throughput averages rates over. Zero means defaultThroughputWindow.
+	ThroughputWindow time.Duration
+	// StatsPath, when set, serves a JSON document with uptime, connection count and throughput on this path.
+	StatsPath string
+	// StatsToken, when set, must be sent as a bearer token in the Authorization header to read StatsPath.
+	StatsToken string
+	// TCPKeepAlive is the keep-alive period of accepted TCP connections, so the OS reaps peers that vanished
+	// without closing. Zero uses Go's default of 15 seconds and a negative value disables it.
+	// It complements the client's application heartbeat: keep-alive probes detect dead peers even when
+	// a client stops sending anything, while the heartbeat keeps idle connections open through proxies.
+	TCPKeepAlive time.Duration
+	// TLSConfig, when set, makes Run serve TLS, clients then connect with wss.
+	// To authenticate clients by certificate, set its ClientAuth and ClientCAs and enable ClientCertAuth.
+	TLSConfig *tls.Config
+	// ClientCertAuth authenticates clients by a verified TLS client certificate instead of the password.
+	// The ClientID is taken from the certificate's common name, or its first DNS name, and the id parameter is ignored.
+	// Connections without a verified certificate are rejected. It requires TLSConfig.
+	ClientCertAuth bool
+	// Clock is the source of time for timestamps, windows and waits, nil means the real clock.
+	Clock Clock
+	// EvictionPolicy picks the connections SetMaxConnections evicts when it lowers the limit below the current count.
+	EvictionPolicy EvictionPolicy
+	// TextNoticeFormat is how error, system and maintenance messages are written to TextProtocol connections.
+	TextNoticeFormat TextNoticeFormat
+	// UnknownTypePolicy applies to messages from JSONProtocol connections with an unrecognized Type.
+	// The types only the server sends, error, system and maintenance, are always refused with a reserved_type error.
+	UnknownTypePolicy UnknownTypePolicy
+	// NormalizeWhitespace trims chat messages and collapses runs of whitespace into a single space.
+	// With AllowMultiline, single newlines are kept and runs of blank lines collapse into one newline.
+	NormalizeWhitespace bool
+	AllowMultiline      bool
+	// WelcomeBanner is sent to each client as a system message once it is accepted, before any broadcast.
+	// Empty sends nothing.
+	WelcomeBanner string
+	// OnConnect is called once a connection is registered, before any of its messages are read.
+	// The ConnContext gives access to the HTTP request and can store values for later hooks.
+	OnConnect func(conn *ConnContext)
+	// OnMessage is called with each message a connection sends before it is broadcast,
+	// along with the same ConnContext OnConnect received.
+	OnMessage func(conn *ConnContext, message Message)
+	// PausePolicy is what happens to chat messages from users while the chat room is paused, see Pause.
+	PausePolicy PausePolicy
+	// Localizer, when set, translates the server's own messages for clients that registered with a locale.
+	Localizer Localizer
+	// PerRecipientTransform, when set, is applied to every broadcast and Push just before it is written to
+	// a connection, so the same message can be rendered per recipient, for example to flag a mention.
+	// It gets a copy of the message and returns what that recipient receives. It is called while the next
+	// broadcast waits, so it must not block or call back into the server. It must be safe for concurrent use:
+	// with BroadcastWorkers above one it runs for several recipients of a broadcast at once, and Push calls it
+	// alongside broadcasts.
+	PerRecipientTransform func(recipient ConnectionInfo, message Message) Message
+	// OnAuthSuccess is called when a WebSocket connection passes authentication and the ClientID checks,
+	// with the request that opened it and the ClientID it was accepted with. It is meant for audit records
+	// and is called whether or not the server logs.
+	OnAuthSuccess func(r *http.Request, clientID string)
+	// OnAuthFailure is called when a WebSocket connection is rejected by authentication or the ClientID checks,
+	// with the request that opened it and the reason, such as ReasonIncorrectPassword or ReasonInvalidClientID.
+	// The request carries the remote address and the attempted id parameter.
+	OnAuthFailure func(r *http.Request, reason string)
+
 	listenAddr     string
 	password       string
 	serverConnPool *connPool
+	// logger writes all of the server's log output, see SetLogOutput.
+	logger *log.Logger
+	// throughput counts messages in and out for Throughput.
+	throughput throughput
+	// lastConnID is used to assign connection IDs.
+	lastConnID atomic.Uint64
+	// broadcastMu serializes broadcasts, so every connection receives them in Seq order.
+	broadcastMu sync.Mutex
+	// handshakes tracks the connections still in their handshake, see PendingHandshakes.
+	handshakes handshakeTracker
+	// broadcastBucket enforces MaxBroadcastsPerSec.
+	broadcastBucket tokenBucket
+	// lastSeq is the sequence number of the last broadcast message.
+	lastSeq atomic.Uint64
+	// maxConns is the connection limit set by SetMaxConnections, zero means no limit.
+	maxConns atomic.Int64
+	// rejecting is set while new connections are turned away, see SetAcceptingConnections.
+	rejecting atomic.Bool
+	poolOnce  sync.Once
+	// claimMu serializes claim_id messages, so two connections can not claim the same ClientID at once.
+	claimMu sync.Mutex
+	// pauseMu guards paused and pausedQueue, the messages PauseQueue holds until Resume.
+	pauseMu     sync.Mutex
+	paused      bool
+	pausedQueue []pausedMessage
+
+	// mu guards httpServer, which is only set while Run is serving, and startedAt.
+	mu         sync.Mutex
+	httpServer *http.Server
+	startedAt  time.Time
 }
 
 // A connPool is used to store all the WebSocket connections, and utilizes channels for registering and unregistering them.
 type connPool struct {
-	connections []*websocket.Conn
-	register    chan *websocket.Conn
-	unregister  chan *websocket.Conn
+	// mu guards connections, which is read outside of the execute loop, and claimed.
+	// It also guards replacing register when the pool starts, and queueing into its backlog.
+	mu          sync.Mutex
+	connections []*connection
+	// claimed holds the transports being served, from before they are registered until they are unregistered,
+	// so the same transport can not be registered twice.
+	claimed    map[Transport]bool
+	register   chan *connection
+	unregister chan *connection
+	// logger is shared with the ChatServer.
+	logger *log.Logger
+	// rejected counts the connections turned away because the register backlog was full.
+	rejected atomic.Uint64
+	// quit is closed to stop the execute loop, which closes stopped once the pool is empty.
+	quit     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+	// Pool change logging settings copied from ChatServer, and the rate limiting state used by execute.
+	logChanges  bool
+	logInterval time.Duration
+	clock       Clock
+	lastLog     time.Time
+	suppressed  int
+}
+
+// ConnContext describes a registered connection to the OnConnect and OnMessage hooks.
+// Values stored with Set during OnConnect can be read back with Get during OnMessage.
+type ConnContext struct {
+	// ID is assigned by the server and unique among its connections, it can be used with Push.
+	ID string
+	// Request is the HTTP request that opened the WebSocket connection, with its headers, cookies and query.
+	// It is nil for connections served with ServeTransport.
+	Request *http.Request
+
+	mu     sync.Mutex
+	values map[string]any
+}
+
+// Stores a value on the connection under key.
+func (ctx *ConnContext) Set(key string, value any) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.values == nil {
+		ctx.values = make(map[string]any)
+	}
+	ctx.values[key] = value
+}
+
+// Returns the value stored on the connection under key, and whether it was set.
+func (ctx *ConnContext) Get(key string) (value any, ok bool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	value, ok = ctx.values[key]
+	return value, ok
+}
+
+// ConnectionInfo describes a registered connection.
+type ConnectionInfo struct {
+	// ID is assigned by the server and unique among its connections.
+	ID         string
+	RemoteAddr string
+	// ClientID is the ID the client registered with, it may be empty.
+	ClientID string
+	// Role is granted by the password the connection registered with.
+	Role string
+	// Listener connections only receive messages.
+	Listener bool
+	// LastActivity is when the connection last sent or received a frame, heartbeats included,
+	// by the server's Clock. It can tell idle connections apart.
+	LastActivity time.Time
+}
+
+// A connection is a registered Transport and its server-side state.
+type connection struct {
+	t Transport
+	// ctx is handed to the OnConnect and OnMessage hooks.
+	ctx *ConnContext
+	// clientID is the ID the client registered with, it may be empty. It can be changed by a claim_id message,
+	// idMu guards it once the connection is served.
+	idMu     sync.Mutex
+	clientID string
+	// locale is the locale the client registered with for the server's own messages, it may be empty.
+	locale string
+	// listener connections receive broadcasts but are not allowed to send messages.
+	listener bool
+	// echo connections also receive the messages they send themselves.
+	echo bool
+	// role is granted by the password the connection registered with.
+	role string
+	// badFrames counts consecutive frames that could not be decoded, it is only used by readMessage.
+	badFrames int
+	// How many times each message body was sent since the duplicate window started,
+	// only used by readMessage to detect duplicates.
+	dupCounts     map[string]int
+	dupWindowFrom time.Time
+	// closed is set once the connection is known to be gone, so it is unregistered only once.
+	closed atomic.Bool
+	// streamsMu guards streams, the chunked messages being reassembled by their StreamID.
+	streamsMu sync.Mutex
+	streams   map[string]*chunkStream
+	// sendMu serializes sends, so delivery sequence numbers go out in order.
+	sendMu sync.Mutex
+	// delivered is the delivery sequence number of the last message sent to the connection.
+	delivered uint64
+	// clock is the server's Clock.
+	clock Clock
+	// lastActivity is the time of the last frame sent or received in Unix nanoseconds, see touch.
+	lastActivity atomic.Int64
+	// stopAndWait holds each message until the client acked the one before it, within ackTimeout on clock.
+	// Once served, its messages are queued in outbox and written by writeAcked, so no sender waits for the ack.
+	// acked is the highest delivery sequence number the client acked, ackSignal wakes the writer waiting for it.
+	// outboxDone is closed when the connection is no longer served, which stops the writer.
+	stopAndWait bool
+	ackTimeout  time.Duration
+	acked       atomic.Uint64
+	ackSignal   chan struct{}
+	outbox      chan Message
+	outboxDone  chan struct{}
+	// sendRetries is how many times a send that failed with a transient error is retried, see ChatServer.SendRetries.
+	sendRetries int
+}
+
+// Returns the public description of the connection.
+func (conn *connection) info() ConnectionInfo {
+	return ConnectionInfo{
+		ID:           conn.ctx.ID,
+		RemoteAddr:   conn.t.RemoteAddr(),
+		ClientID:     conn.getClientID(),
+		Role:         conn.role,
+		Listener:     conn.listener,
+		LastActivity: time.Unix(0, conn.lastActivity.Load()),
+	}
+}
+
+// Returns the connection's current ClientID.
+func (conn *connection) getClientID() string {
+	conn.idMu.Lock()
+	defer conn.idMu.Unlock()
+	return conn.clientID
+}
+
+// Sends the message stamped with the next delivery sequence number of the connection.
+// In stop-and-wait mode the message is queued instead, and goes out once the client acked the previous one.
+func (conn *connection) send(message Message) error {
+	return conn.sendMessage(message, true)
+}
+
+// Sends a message at once, even in stop-and-wait mode, so it may go out with a message still unacked.
+// It is used for replies from the connection's own reader goroutine and for a last notice before closing.
+func (conn *connection) reply(message Message) error {
+	return conn.sendMessage(message, false)
+}
+
+// Sends the message, or queues it for writeAcked if wait is set and the connection is in stop-and-wait mode.
+// A queued message counts as sent, errAckQueueFull is returned if the queue is full.
+func (conn *connection) sendMessage(message Message, wait bool) error {
+	if wait && conn.outbox != nil {
+		select {
+		case conn.outbox <- message:
+			return nil
+		default:
+			return errAckQueueFull
+		}
+	}
+	return conn.write(message)
+}
+
+// Waits until the client acked every message sent so far, for up to ackTimeout.
+// Returns errConnDone if the connection stops being served in the meantime.
+func (conn *connection) waitForAck() error {
+	var timeout <-chan time.Time
+	for {
+		conn.sendMu.Lock()
+		pending := conn.acked.Load() < conn.delivered
+		conn.sendMu.Unlock()
+		if !pending {
+			return nil
+		}
+		// The timer is only started once there is something to wait for.
+		if timeout == nil {
+			timeout = conn.clock.After(conn.ackTimeout)
+		}
+		select {
+		case <-conn.ackSignal:
+		case <-timeout:
+			return errAckTimeout
+		case <-conn.outboxDone:
+			return errConnDone
+		}
+	}
+}
+
+// Writes the message stamped with the next delivery sequence number, retrying transient errors.
+func (conn *connection) write(message Message) error {
+	conn.sendMu.Lock()
+	defer conn.sendMu.Unlock()
+	conn.delivered++
+	message.DeliverySeq = conn.delivered
+	err := conn.t.Send(message)
+	backoff := defaultSendRetryBackoff
+	for retry := 0; err != nil && isTransient(err) && retry < conn.sendRetries; retry++ {
+		<-conn.clock.After(backoff)
+		backoff *= 2
+		err = conn.t.Send(message)
+	}
+	if err != nil {
+		return err
+	}
+	conn.touch()
+	return nil
+}
+
+// Records that a frame was just sent or received.
+func (conn *connection) touch() {
+	conn.lastActivity.Store(conn.clock.Now().UnixNano())
+}
+
+// Records that the client acked the messages up to deliverySeq and wakes the writer waiting for it.
+func (conn *connection) ack(deliverySeq uint64) {
+	for {
+		acked := conn.acked.Load()
+		if deliverySeq <= acked || conn.acked.CompareAndSwap(acked, deliverySeq) {
+			break
+		}
+	}
+	select {
+	case conn.ackSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Marks the connection as closed and reports whether this call was the one that closed it.
+// Only the caller that gets true should unregister the connection.
+func (conn *connection) markClosed() bool {
+	return conn.closed.CompareAndSwap(false, true)
 }
 
 // ChatServer constructor.
@@ -28,52 +501,198 @@ func NewChatServer(listenAddr, password string) *ChatServer {
 	chatServer := new(ChatServer)
 	chatServer.listenAddr = listenAddr
 	chatServer.password = password
+	// Start from the standard logger's settings, so existing log configuration still applies.
+	chatServer.logger = log.New(log.Writer(), log.Prefix(), log.Flags())
 	chatServer.serverConnPool = &connPool{
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
+		logger:     chatServer.logger,
+		register:   make(chan *connection),
+		unregister: make(chan *connection),
+		quit:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		claimed:    make(map[Transport]bool),
 	}
 	return chatServer
 }
 
 // Uses channel to detect the register and unregister on connPool,
 // Call this function with goroutine to avoid infinite loop.
+// The loop ends when the pool is stopped, closing every remaining connection.
 func (c *connPool) execute() {
 	// Infinite loop to catch register and unregister event.
 	for {
 		select {
+		// Close the remaining connections and leave the pool empty when catch quit event.
+		case <-c.quit:
+			c.mu.Lock()
+			remaining := c.connections
+			c.connections = nil
+			// Registrations still waiting in the backlog are closed too, add takes c.mu to queue one
+			// and does not once quit is closed, so none can slip in after this.
+			for len(c.register) > 0 {
+				remaining = append(remaining, <-c.register)
+			}
+			clear(c.claimed)
+			c.mu.Unlock()
+			for _, conn := range remaining {
+				conn.markClosed()
+				conn.t.Close()
+			}
+			if c.logChanges {
+				c.logger.Println("Connection pool stopped, closed", len(remaining), "connections. Connections: 0")
+			}
+			close(c.stopped)
+			return
 		// Add WebSocket connection to the pool when catch register event.
 		case r := <-c.register:
+			c.mu.Lock()
+			// A connection that closed while its registration waited in the backlog may already have been
+			// unregistered, with nothing to remove. Adding it now would keep it in the pool for good.
+			if r.closed.Load() {
+				delete(c.claimed, r.t)
+				c.mu.Unlock()
+				continue
+			}
 			c.connections = append(c.connections, r)
-			log.Println("WebSocket connected,", r.Request().RemoteAddr, "register.")
-			log.Println("Current connection pool:", c.GetPoolAddr())
+			count := len(c.connections)
+			c.mu.Unlock()
+			c.logChange("WebSocket connected, "+r.t.RemoteAddr()+" register.", count)
 		// Remove WebSocket connection from the pool when catch unregister event.
 		case r := <-c.unregister:
+			c.mu.Lock()
 			c.connections = removeConn(c.connections, r)
-			log.Println("WebSocket disconnected,", r.Request().RemoteAddr, "unregister.")
-			log.Println("Current connection pool:", c.GetPoolAddr())
+			delete(c.claimed, r.t)
+			count := len(c.connections)
+			c.mu.Unlock()
+			c.logChange("WebSocket disconnected, "+r.t.RemoteAddr()+" unregister.", count)
 		}
 	}
 }
 
+// Sends the register event to the execute loop. Returns errPoolStopped if the pool has been stopped,
+// or errBacklogFull if the register events are buffered and the buffer is full.
+func (c *connPool) add(conn *connection) error {
+	if cap(c.register) == 0 {
+		select {
+		case c.register <- conn:
+			return nil
+		case <-c.quit:
+			return errPoolStopped
+		}
+	}
+	// Queueing under c.mu keeps the registration from landing in the backlog after execute emptied it on quit.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.quit:
+		return errPoolStopped
+	default:
+	}
+	select {
+	case c.register <- conn:
+		return nil
+	default:
+		c.rejected.Add(1)
+		return errBacklogFull
+	}
+}
+
+// Sends the unregister event to the execute loop, it is dropped if the pool has been stopped
+// because a stopped pool is already empty.
+func (c *connPool) remove(conn *connection) {
+	select {
+	case c.unregister <- conn:
+	case <-c.quit:
+	}
+}
+
+// Claims the transport for a connection about to be registered.
+// Returns errAlreadyClaimed if the transport is already claimed, by a registered connection or one on its way in,
+// and errPoolFull if limit is positive and that many transports are claimed.
+func (c *connPool) claim(t Transport, limit int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.claimed[t] {
+		return errAlreadyClaimed
+	}
+	if limit > 0 && len(c.claimed) >= limit {
+		return errPoolFull
+	}
+	c.claimed[t] = true
+	return nil
+}
+
+// Releases the claim of a connection that did not make it into the pool.
+func (c *connPool) release(t Transport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.claimed, t)
+}
+
+// Stops the execute loop and waits until it has closed the remaining connections.
+// Register and unregister events sent after this are dropped.
+func (c *connPool) stop() {
+	c.stopOnce.Do(func() { close(c.quit) })
+	<-c.stopped
+}
+
+// Logs a pool change with the new pool size if logging is enabled and not rate limited.
+// Changes skipped by the rate limit are counted and reported with the next logged change.
+func (c *connPool) logChange(change string, count int) {
+	if !c.logChanges {
+		return
+	}
+	if c.logInterval > 0 && c.clock.Now().Sub(c.lastLog) < c.logInterval {
+		c.suppressed++
+		return
+	}
+	if c.suppressed > 0 {
+		c.logger.Println(change, "Connections:", count, "Changes not logged:", c.suppressed)
+	} else {
+		c.logger.Println(change, "Connections:", count)
+	}
+	c.lastLog = c.clock.Now()
+	c.suppressed = 0
+}
+
 // Retrieves all IP addresses of the connections in connPool.
 func (c *connPool) GetPoolAddr() []string {
 	var slice []string
-	for _, ws := range c.connections {
-		slice = append(slice, ws.Request().RemoteAddr)
+	for _, conn := range c.snapshot() {
+		slice = append(slice, conn.t.RemoteAddr())
 	}
 	return slice
 }
 
-// Removes the WebSocket connection elem from the slice and returns the modified slice.
+// Calls fn for each registered connection until fn returns false, without copying the pool.
+// fn is called while the pool is locked, so it must not block or call back into the server.
+func (s *ChatServer) ForEachConnection(fn func(ConnectionInfo) bool) {
+	pool := s.serverConnPool
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, conn := range pool.connections {
+		if !fn(conn.info()) {
+			return
+		}
+	}
+}
+
+// Returns a copy of the connections in connPool, safe to range over while the pool changes.
+func (c *connPool) snapshot() []*connection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*connection(nil), c.connections...)
+}
+
+// Removes the connection elem from the slice and returns the modified slice.
 // If elem does not exist in the slice, returns the original unchanged slice.
-func removeConn(slice []*websocket.Conn, elem *websocket.Conn) []*websocket.Conn {
+func removeConn(slice []*connection, elem *connection) []*connection {
 	var newSliceLen int
 	if len(slice) <= 0 {
 		newSliceLen = 0
 	} else {
 		newSliceLen = len(slice) - 1
 	}
-	newSlice := make([]*websocket.Conn, newSliceLen)
+	newSlice := make([]*connection, newSliceLen)
 	for i, origElem := range slice {
 		if origElem == elem {
 			newSlice = append(slice[:i], slice[i+1:]...)
@@ -91,56 +710,773 @@ func (s *ChatServer) registerServer(ws *websocket.Conn) {
 	// Get chatroom password parameter form url.
 	params := ws.Request().URL.Query()
 	password := params.Get("pwd")
+	clientID := params.Get("id")
 	// Check the password is correct or not,
 	// if the chat server is public, skip password checking.
-	if s.password == "" || s.password == password {
+	role, ok := s.authenticate(password)
+	if s.ClientCertAuth {
+		clientID, ok = clientIDFromCert(ws.Request().TLS)
+		role = RoleUser
+	}
+	// The handshake is over once the password is checked.
+	releaseHandshake(ws.Request())
+	if ok {
+		t := newWSTransport(ws, s.WriteTimeout, s.Codec, s.TextNoticeFormat)
+		if reason, err := s.checkClientID(clientID); err != nil {
+			s.logger.Println(ws.Request().RemoteAddr, "Client connection failed:", err)
+			s.authFailed(ws.Request(), reason)
+			t.Send(s.localize(params.Get("locale"), Message{Type: MessageTypeError, Body: err.Error(), Reason: reason}))
+			return
+		}
+		if s.OnAuthSuccess != nil {
+			s.OnAuthSuccess(ws.Request(), clientID)
+		}
 		// Register the connection to the ConnPool and continue listening.
-		s.serverConnPool.register <- ws
-		s.readMessage(ws)
+		conn := &connection{
+			t:        t,
+			ctx:      &ConnContext{Request: ws.Request()},
+			clientID: clientID,
+			listener: params.Get("role") == roleListener,
+			echo:     params.Get("echo") == "true",
+			role:     role,
+			locale:   params.Get("locale"),
+			// Acks are JSON messages, a text connection could never send one.
+			stopAndWait: params.Get("ack") == "true" && t.protocol == JSONProtocol,
+		}
+		s.serve(conn)
+	} else if s.ClientCertAuth {
+		s.logger.Println(ws.Request().RemoteAddr, "Client connection failed: No verified client certificate.")
+		s.authFailed(ws.Request(), ReasonNoClientCert)
 	} else {
-		log.Println(ws.Request().RemoteAddr, "Client connection failed: Incorrect password.")
-		// TODO: send error message to client
+		s.logger.Println(ws.Request().RemoteAddr, "Client connection failed: Incorrect password.")
+		s.authFailed(ws.Request(), ReasonIncorrectPassword)
+		t := newWSTransport(ws, s.WriteTimeout, s.Codec, s.TextNoticeFormat)
+		t.Send(s.localize(params.Get("locale"), Message{Type: MessageTypeError, Body: "Incorrect password.", Reason: ReasonIncorrectPassword}))
+	}
+}
+
+// Runs the OnAuthFailure hook, if any.
+func (s *ChatServer) authFailed(r *http.Request, reason string) {
+	if s.OnAuthFailure != nil {
+		s.OnAuthFailure(r, reason)
+	}
+}
+
+// Sets where the server's log output goes, by default the standard logger's output when the server was created.
+// All of the server's logging, including connection pool changes, goes through this writer,
+// so a rotating or compressing writer can be plugged in. It is safe to call while the server runs.
+func (s *ChatServer) SetLogOutput(w io.Writer) {
+	s.logger.SetOutput(w)
+}
+
+// Checks the ClientID a connection registered with against RequireClientID and ClientIDPattern.
+// Returns the error reason to send to the client along with the error.
+func (s *ChatServer) checkClientID(clientID string) (reason string, err error) {
+	if clientID == "" {
+		if s.RequireClientID {
+			return ReasonClientIDRequired, errors.New("ClientID is required.")
+		}
+		return "", nil
+	}
+	if s.ClientIDPattern != nil && !s.ClientIDPattern.MatchString(clientID) {
+		return ReasonInvalidClientID, errors.New("ClientID has an invalid format.")
+	}
+	return "", nil
+}
+
+// Changes the ClientID of conn to id if no other connection has it, and broadcasts a rename notice.
+// The new ID must pass the same checks as one given at registration. A rejected claim leaves the ClientID
+// unchanged and is answered with an error. With ClientCertAuth the ClientID belongs to the certificate
+// and can not be claimed.
+func (s *ChatServer) claimID(conn *connection, id string) {
+	reject := func(body, reason string) {
+		conn.reply(s.localize(conn.locale, Message{Type: MessageTypeError, Body: body, Reason: reason}))
+	}
+	if s.ClientCertAuth {
+		reject("ClientID is set by the client certificate.", ReasonInvalidClientID)
+		return
+	}
+	if id == "" {
+		reject("ClientID is required.", ReasonClientIDRequired)
+		return
+	}
+	if reason, err := s.checkClientID(id); err != nil {
+		reject(err.Error(), reason)
+		return
+	}
+	s.claimMu.Lock()
+	for _, other := range s.serverConnPool.snapshot() {
+		if other != conn && other.getClientID() == id {
+			s.claimMu.Unlock()
+			reject("ClientID "+id+" is taken.", ReasonClientIDTaken)
+			return
+		}
+	}
+	conn.idMu.Lock()
+	old := conn.clientID
+	conn.clientID = id
+	conn.idMu.Unlock()
+	s.claimMu.Unlock()
+	if old == id {
+		return
+	}
+	if old == "" {
+		old = "Connection " + conn.ctx.ID
+	}
+	s.logger.Println(conn.t.RemoteAddr(), "claimed ClientID", id)
+	// deliverTo translates the notice for each recipient.
+	s.broadcastFrom(nil, Message{Type: MessageTypeSystem, Body: old + " is now known as " + id + "."})
+}
+
+// Returns the number of consecutive bad frames a connection may send.
+func (s *ChatServer) maxBadFrames() int {
+	if s.MaxBadFrames <= 0 {
+		return defaultMaxBadFrames
+	}
+	return s.MaxBadFrames
+}
+
+// Returns the role granted by the password and whether the password is accepted.
+// Without Passwords, a public server or the single server password grants RoleUser.
+func (s *ChatServer) authenticate(password string) (role string, ok bool) {
+	if len(s.Passwords) > 0 {
+		role, ok = s.Passwords[password]
+		return role, ok
+	}
+	if s.password == "" || s.password == password {
+		return RoleUser, true
+	}
+	return "", false
+}
+
+// Returns the ClientID of the verified client certificate of a TLS connection,
+// its common name or else its first DNS name. Reports false if there is none.
+func clientIDFromCert(state *tls.ConnectionState) (clientID string, ok bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cert := state.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, true
 	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0], true
+	}
+	return "", false
+}
+
+// Registers the transport to the ConnPool and serves it until it is closed, then closes it.
+// The password is not checked, the caller is responsible for authenticating the transport.
+// The connection is granted RoleUser.
+// A transport that is already being served is left alone, the call returns at once.
+func (s *ChatServer) ServeTransport(t Transport) {
+	s.startPool()
+	if s.serve(&connection{t: t, ctx: new(ConnContext), role: RoleUser}) {
+		t.Close()
+	}
+}
+
+// Assigns a connection ID, registers the connection to the ConnPool, runs the OnConnect hook
+// and keeps reading its messages.
+// Returns false without touching the transport if it is already being served, so it is never registered twice.
+func (s *ChatServer) serve(conn *connection) (served bool) {
+	conn.clock = s.clock()
+	conn.sendRetries = s.SendRetries
+	if conn.sendRetries == 0 {
+		conn.sendRetries = defaultSendRetries
+	}
+	if err := s.serverConnPool.claim(conn.t, s.MaxConnections()); errors.Is(err, errAlreadyClaimed) {
+		s.logger.Println(conn.t.RemoteAddr(), "Client connection ignored: Already registered.")
+		return false
+	} else if err != nil {
+		s.logger.Println(conn.t.RemoteAddr(), "Client connection rejected:", err)
+		conn.send(s.localize(conn.locale, Message{Type: MessageTypeError, Body: "The chat server is full, try again later.", Reason: ReasonServerFull}))
+		return true
+	}
+	if s.rejecting.Load() {
+		s.serverConnPool.release(conn.t)
+		s.logger.Println(conn.t.RemoteAddr(), "Client connection rejected: Not accepting connections.")
+		conn.send(s.localize(conn.locale, Message{Type: MessageTypeMaintenance, Body: "The chat server is not accepting connections."}))
+		return true
+	}
+	conn.ctx.ID = strconv.FormatUint(s.lastConnID.Add(1), 10)
+	conn.touch()
+	// Greet the client before it joins the pool, so no broadcast can arrive ahead of the banner.
+	// Nothing was sent before it, so it never waits for an ack.
+	if s.WelcomeBanner != "" {
+		if err := conn.send(s.localize(conn.locale, Message{Type: MessageTypeSystem, Body: s.WelcomeBanner})); err != nil {
+			s.serverConnPool.release(conn.t)
+			s.logger.Println("Can not send welcome banner to", conn.t.RemoteAddr(), ":", err)
+			conn.t.Close()
+			return true
+		}
+	}
+	if conn.stopAndWait {
+		conn.ackTimeout = s.AckTimeout
+		if conn.ackTimeout <= 0 {
+			conn.ackTimeout = defaultAckTimeout
+		}
+		conn.ackSignal = make(chan struct{}, 1)
+		conn.outbox = make(chan Message, ackQueueSize)
+		conn.outboxDone = make(chan struct{})
+		defer close(conn.outboxDone)
+		go s.writeAcked(conn)
+	}
+	if err := s.serverConnPool.add(conn); err != nil {
+		s.serverConnPool.release(conn.t)
+		if errors.Is(err, errBacklogFull) {
+			s.logger.Println(conn.t.RemoteAddr(), "Client connection rejected:", err)
+			conn.reply(s.localize(conn.locale, Message{Type: MessageTypeError, Body: "The chat server is busy, try again later.", Reason: ReasonBusy}))
+		}
+		return true
+	}
+	if s.OnConnect != nil {
+		s.OnConnect(conn.ctx)
+	}
+	s.readMessage(conn)
+	return true
+}
+
+// A blocking function that writes the queued messages of a stop-and-wait connection, each once the client
+// acked the one before it, until the connection is no longer served. If an ack does not arrive within
+// AckTimeout or a write fails, the connection is closed and unregistered.
+func (s *ChatServer) writeAcked(conn *connection) {
+	for {
+		var message Message
+		select {
+		case message = <-conn.outbox:
+		case <-conn.outboxDone:
+			return
+		}
+		err := conn.waitForAck()
+		if err == nil {
+			err = conn.write(message)
+		}
+		if errors.Is(err, errConnDone) {
+			return
+		}
+		if err != nil {
+			if conn.markClosed() {
+				s.dropConn(conn)
+				s.logger.Println(conn.t.RemoteAddr(), "disconnected :", err)
+			}
+			return
+		}
+	}
+}
+
+// Starts listening the ConnPool once, from Run or the first ServeTransport.
+// Pool settings are taken from the ChatServer at this point.
+func (s *ChatServer) startPool() {
+	s.poolOnce.Do(func() {
+		s.serverConnPool.logChanges = s.LogPoolChanges
+		s.serverConnPool.logInterval = s.PoolLogInterval
+		s.serverConnPool.clock = s.clock()
+		if s.RegisterBacklog > 0 {
+			// Backlog may read the channel at any time, everyone else only uses it once the pool is started.
+			s.serverConnPool.mu.Lock()
+			s.serverConnPool.register = make(chan *connection, s.RegisterBacklog)
+			s.serverConnPool.mu.Unlock()
+		}
+		go s.serverConnPool.execute()
+		window := s.ThroughputWindow
+		if window <= 0 {
+			window = defaultThroughputWindow
+		}
+		s.throughput.start(window, s.clock(), s.serverConnPool.quit)
+	})
+}
+
+// Returns the server's Clock, or the real clock if none is set.
+func (s *ChatServer) clock() Clock {
+	return clockOrReal(s.Clock)
+}
+
+// Stops the ConnPool, starting it first if needed so the stop always completes.
+func (s *ChatServer) stopPool() {
+	s.startPool()
+	s.serverConnPool.stop()
+}
+
+// Checks the origin like websocket.Handler does, and picks the wire format from the offered subprotocols.
+// If neither TextProtocol nor JSONProtocol is offered, the offered subprotocols are left untouched and
+// the connection uses the text format.
+func negotiateProtocol(config *websocket.Config, req *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, req)
+	if err == nil && config.Origin == nil {
+		return fmt.Errorf("null origin")
+	}
+	if err != nil {
+		return err
+	}
+	for _, protocol := range config.Protocol {
+		if protocol == JSONProtocol || protocol == TextProtocol {
+			config.Protocol = []string{protocol}
+			return nil
+		}
+	}
+	return nil
 }
 
 // A blocking function that continues listening for WebSocket messages.
 // If the connection is disconnected, it should be unregistered from the ConnPool.
-func (s *ChatServer) readMessage(ws *websocket.Conn) {
-	var message string
+func (s *ChatServer) readMessage(conn *connection) {
 	for {
-		err := websocket.Message.Receive(ws, &message)
+		message, err := conn.t.Receive()
+		if err == nil || errors.Is(err, ErrBadFrame) {
+			conn.touch()
+		}
+		if errors.Is(err, ErrBadFrame) {
+			conn.badFrames++
+			if conn.badFrames <= s.maxBadFrames() {
+				s.logger.Println(conn.t.RemoteAddr(), "sent a bad frame:", err)
+				conn.reply(s.localize(conn.locale, Message{Type: MessageTypeError, Body: "Bad frame.", Reason: ReasonBadFrame}))
+				continue
+			}
+			err = fmt.Errorf("too many consecutive bad frames: %w", err)
+		}
 		if err != nil {
-			s.serverConnPool.unregister <- ws
-			log.Println(err)
+			if conn.markClosed() {
+				s.serverConnPool.remove(conn)
+			}
+			conn.dropStreams()
+			// io.EOF means the stream ended between frames, with a close frame or a plain TCP close,
+			// the WebSocket library reports both the same way. Anything else, a reset, a timeout
+			// or a frame cut short, is an abnormal termination.
+			if errors.Is(err, io.EOF) {
+				s.logger.Println(conn.t.RemoteAddr(), "disconnected.")
+			} else {
+				s.logger.Println(conn.t.RemoteAddr(), "connection error:", err)
+			}
 			return
 		}
-		log.Println(ws.Request().RemoteAddr, ":", message)
-		s.Broadcast(message)
+		conn.badFrames = 0
+		// Heartbeats of both wire formats arrive as typed messages, they are not meant for the chatroom.
+		if message.Type == MessageTypeHeartbeat {
+			continue
+		}
+		if message.Type == MessageTypeAck {
+			if conn.stopAndWait {
+				conn.ack(message.DeliverySeq)
+			}
+			continue
+		}
+		if message.Type == MessageTypeClaimID {
+			s.claimID(conn, message.ID)
+			continue
+		}
+		s.throughput.addIn(len(message.Body))
+		// An empty Type is treated as a chat message.
+		if message.Type == "" {
+			message.Type = MessageTypeChat
+		}
+		// Only chat messages are normalized, other types are control frames.
+		// Binary frames are relayed byte for byte.
+		if s.NormalizeWhitespace && message.Type == MessageTypeChat && !message.Binary {
+			message.Body = normalizeWhitespace(message.Body, s.AllowMultiline)
+		}
+		// Odd clients can send empty frames, they are not worth broadcasting.
+		if message.Body == "" && message.Type == MessageTypeChat {
+			s.logger.Println(conn.t.RemoteAddr(), "sent an empty message, skipped.")
+			continue
+		}
+		if conn.listener {
+			conn.reply(s.localize(conn.locale, Message{Type: MessageTypeError, Body: "Listeners can not send messages."}))
+			continue
+		}
+		if message.Type == MessageTypeChunk {
+			var complete bool
+			if message, complete = s.addChunk(conn, message); !complete {
+				continue
+			}
+		}
+		// Server-only types are refused whatever the UnknownTypePolicy, a forged maintenance message
+		// would make the peers' clients think the server is going away.
+		if serverOnlyType(message.Type) {
+			s.logger.Println(conn.t.RemoteAddr(), "sent a message of reserved type", message.Type)
+			conn.reply(s.localize(conn.locale, Message{Type: MessageTypeError, Body: "Message type " + message.Type + " is reserved for the server.", Reason: ReasonReservedType}))
+			continue
+		}
+		if message.Type != MessageTypeChat {
+			s.handleUnknownType(conn, message)
+			continue
+		}
+		if s.isDuplicate(conn, message.Body) {
+			conn.reply(s.localize(conn.locale, Message{Type: MessageTypeError, Body: "Stop sending the same message.", Reason: ReasonDuplicate}))
+			continue
+		}
+		if message.Binary {
+			s.logger.Println(conn.t.RemoteAddr(), ": binary frame of", len(message.Body), "bytes")
+		} else {
+			s.logger.Println(conn.t.RemoteAddr(), ":", message.Body)
+		}
+		if s.OnMessage != nil {
+			s.OnMessage(conn.ctx, message)
+		}
+		s.broadcastUnlessPaused(conn, Message{Type: MessageTypeChat, Body: message.Body, Binary: message.Binary})
+	}
+}
+
+// Applies the UnknownTypePolicy to a message with an unrecognized Type.
+func (s *ChatServer) handleUnknownType(conn *connection, message Message) {
+	switch s.UnknownTypePolicy {
+	case UnknownTypeError:
+		conn.reply(s.localize(conn.locale, Message{Type: MessageTypeError, Body: "Unknown message type " + message.Type + ".", Reason: ReasonUnknownType}))
+	case UnknownTypeBroadcast:
+		s.broadcastFrom(conn, message)
+	default:
+		s.logger.Println(conn.t.RemoteAddr(), "sent a message of unknown type", message.Type)
+	}
+}
+
+// Trims body and collapses runs of whitespace into a single space.
+// If multiline is set, lines are normalized separately and joined by single newlines, dropping blank lines.
+func normalizeWhitespace(body string, multiline bool) string {
+	if !multiline {
+		return strings.Join(strings.Fields(body), " ")
+	}
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Reports whether body has been sent by the connection more than DuplicateLimit times within DuplicateWindow.
+func (s *ChatServer) isDuplicate(conn *connection, body string) bool {
+	if s.DuplicateLimit <= 0 {
+		return false
+	}
+	window := s.DuplicateWindow
+	if window <= 0 {
+		window = defaultDuplicateWindow
+	}
+	now := s.clock().Now()
+	// Counts are kept per fixed window, so they only hold the bodies of the current window.
+	if conn.dupCounts == nil || now.Sub(conn.dupWindowFrom) >= window {
+		conn.dupCounts = make(map[string]int)
+		conn.dupWindowFrom = now
+	}
+	conn.dupCounts[body]++
+	return conn.dupCounts[body] > s.DuplicateLimit
+}
+
+// Closes a connection whose write failed and removes it from ConnPool, the caller must have won markClosed.
+// A failed or timed out write can leave a partial frame on the wire, so the connection is not used again,
+// closing it also ends its reader goroutine.
+func (s *ChatServer) dropConn(conn *connection) {
+	conn.t.Close()
+	s.serverConnPool.remove(conn)
+}
+
+// Sends the message to the connection with the given server-assigned ID only.
+// Returns an error if no such connection is registered or the send fails, in which case it is unregistered.
+func (s *ChatServer) Push(connID string, message Message) error {
+	var target *connection
+	for _, conn := range s.serverConnPool.snapshot() {
+		if conn.ctx.ID == connID {
+			target = conn
+			break
+		}
+	}
+	if target == nil || target.closed.Load() {
+		return fmt.Errorf("connection %s is not connected", connID)
+	}
+	if err := s.sendTo(target, message, true); err != nil {
+		if target.markClosed() {
+			s.dropConn(target)
+		}
+		return fmt.Errorf("can not push to connection %s: %w", connID, err)
+	}
+	s.throughput.addOut(len(message.Body))
+	return nil
+}
+
+// Applies PerRecipientTransform to the message and sends it to conn, see connection.sendMessage for wait.
+func (s *ChatServer) sendTo(conn *connection, message Message, wait bool) error {
+	if s.PerRecipientTransform != nil {
+		message = s.PerRecipientTransform(conn.info(), message)
 	}
+	return conn.sendMessage(message, wait)
 }
 
-// Broadcast the message on the chat server ConnPool.
+// Broadcast the message on the chat server ConnPool, in each connection's negotiated format.
+// Connections that were closed after the pool was read are skipped quietly.
+// A failed send does not stop the broadcast, the connection is unregistered and its error is
+// joined into the returned error once every connection has been tried.
 func (s *ChatServer) Broadcast(message string) (err error) {
-	for _, ws := range s.serverConnPool.connections {
-		if err := websocket.Message.Send(ws, message); err != nil {
-			// Remove the connection from ConnPool
-			s.serverConnPool.unregister <- ws
-			log.Println(ws.Request().RemoteAddr, "disconnected :", err)
-			return err
+	return s.broadcastFrom(nil, Message{Type: MessageTypeChat, Body: message})
+}
+
+// Broadcast the message like Broadcast and block until every write has completed or ctx is done.
+// Returns the number of connections the message was written to, along with the joined send errors.
+// If ctx is done first, the count so far is returned with ctx's error and the remaining writes
+// still complete in the background. A done ctx broadcasts nothing.
+func (s *ChatServer) BroadcastSync(ctx context.Context, message string) (delivered int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var count atomic.Int64
+	done := make(chan error, 1)
+	go func() { done <- s.deliver(nil, Message{Type: MessageTypeChat, Body: message}, &count) }()
+	select {
+	case err := <-done:
+		return int(count.Load()), err
+	case <-ctx.Done():
+		return int(count.Load()), ctx.Err()
+	}
+}
+
+// Broadcast the message sent by sender, the sender only receives it back if it asked for echo.
+// A nil sender means the message comes from the server itself.
+// Every broadcast is stamped with the next sequence number of the server and the time of its Clock.
+// Broadcasts are delivered one at a time, so a slow connection delays the next broadcast by up to WriteTimeout.
+// Within a broadcast, up to BroadcastWorkers connections are written to at once.
+// Messages from clients are subject to MaxBroadcastsPerSec.
+func (s *ChatServer) broadcastFrom(sender *connection, message Message) (err error) {
+	if sender != nil && !s.throttle(sender) {
+		return errThrottled
+	}
+	return s.deliver(sender, message, nil)
+}
+
+// Does the work of broadcastFrom, adding each successful write to delivered if it is not nil.
+func (s *ChatServer) deliver(sender *connection, message Message, delivered *atomic.Int64) (err error) {
+	s.broadcastMu.Lock()
+	defer s.broadcastMu.Unlock()
+	message.Seq = s.lastSeq.Add(1)
+	message.Time = s.clock().Now().UnixMilli()
+	// The role comes from how the sender authenticated, never from the message.
+	message.FromRole = ""
+	if sender != nil {
+		message.FromRole = sender.role
+	}
+	var (
+		errsMu sync.Mutex
+		errs   []error
+		wg     sync.WaitGroup
+	)
+	// workers holds a slot for each write in progress, so at most BroadcastWorkers run at once.
+	workers := make(chan struct{}, max(s.BroadcastWorkers, 1))
+	for _, conn := range s.serverConnPool.snapshot() {
+		if conn.closed.Load() {
+			continue
+		}
+		if conn == sender && !conn.echo {
+			continue
+		}
+		if s.BroadcastWorkers <= 1 {
+			if err := s.deliverTo(sender, conn, message, delivered); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(conn *connection) {
+			defer wg.Done()
+			if err := s.deliverTo(sender, conn, message, delivered); err != nil {
+				errsMu.Lock()
+				errs = append(errs, err)
+				errsMu.Unlock()
+			}
+			<-workers
+		}(conn)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Writes one broadcast message to conn, dropping the connection if the write fails.
+// Returns the failure if this call was the one that dropped it.
+func (s *ChatServer) deliverTo(sender, conn *connection, message Message, delivered *atomic.Int64) error {
+	// The server's own notices are translated for each recipient, chat it broadcasts is passed on as written.
+	if sender == nil && message.Type != MessageTypeChat {
+		message = s.localize(conn.locale, message)
+	}
+	// Stop-and-wait connections only queue the message, so this never waits for an ack,
+	// not even on the sender's own reader goroutine.
+	if err := s.sendTo(conn, message, true); err != nil {
+		// The reader goroutine already closed and unregistered it.
+		if !conn.markClosed() {
+			return nil
 		}
+		s.dropConn(conn)
+		s.logger.Println(conn.t.RemoteAddr(), "disconnected :", err)
+		return fmt.Errorf("%s: %w", conn.t.RemoteAddr(), err)
+	}
+	s.throughput.addOut(len(message.Body))
+	if delivered != nil {
+		delivered.Add(1)
 	}
 	return nil
 }
 
 // A blocking function that run the chat server.
 func (s *ChatServer) Run() {
+	s.run(http.DefaultServeMux)
+}
+
+// Runs the chat server with its handlers registered on mux, tests use a fresh mux per server.
+func (s *ChatServer) run(mux *http.ServeMux) {
 	// Listing ConnPool.
-	go s.serverConnPool.execute()
+	s.startPool()
 	// TODO: Maybe support "/register" to a custom setting.
 	// WebSocket handling.
-	http.Handle("/register", websocket.Handler(s.registerServer))
-	err := http.ListenAndServe(s.listenAddr, nil)
+	var handler http.Handler = websocket.Server{Handler: s.registerServer, Handshake: negotiateProtocol}
+	if s.MaxConcurrentHandshakes > 0 {
+		handler = s.limitHandshakes(handler)
+	}
+	mux.Handle("/register", handler)
+	if s.StatsPath != "" {
+		mux.HandleFunc(s.StatsPath, s.serveStats)
+	}
+	addr := s.listenAddr
+	if addr == "" {
+		addr = ":http"
+	}
+	// Accepted TCP connections get OS-level keep-alive with the configured period.
+	listenConfig := net.ListenConfig{KeepAlive: s.TCPKeepAlive}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", addr)
 	if err != nil {
-		log.Panic("ListenAndServe: " + err.Error())
+		s.logger.Panic("ListenAndServe: " + err.Error())
+	}
+	if s.TLSConfig != nil {
+		listener = tls.NewListener(listener, s.TLSConfig)
+	}
+	server := &http.Server{Addr: s.listenAddr, Handler: mux, ConnState: s.handshakes.connState}
+	s.mu.Lock()
+	s.httpServer = server
+	s.startedAt = s.clock().Now()
+	s.mu.Unlock()
+	err = server.Serve(listener)
+	// ErrServerClosed means the server was stopped on purpose by DrainAndStop.
+	if err != nil && err != http.ErrServerClosed {
+		s.logger.Panic("ListenAndServe: " + err.Error())
+	}
+}
+
+// Sets whether the chat server accepts new connections, it does by default.
+// While it does not, new connections get a maintenance message and are closed,
+// connections already in the pool are left intact. It is safe to call while the server runs.
+func (s *ChatServer) SetAcceptingConnections(accept bool) {
+	s.rejecting.Store(!accept)
+}
+
+// Reports whether the chat server accepts new connections.
+func (s *ChatServer) AcceptingConnections() bool {
+	return !s.rejecting.Load()
+}
+
+// Sets the most connections the chat server serves at once, zero or less means no limit, which is the default.
+// Connections beyond the limit are rejected with a server_full error. If the pool holds more connections
+// than the new limit, the excess is picked by EvictionPolicy, sent a maintenance notice and closed.
+// Returns the number of connections evicted. It is safe to call while the server runs.
+func (s *ChatServer) SetMaxConnections(n int) (evicted int) {
+	s.maxConns.Store(int64(max(n, 0)))
+	conns := s.serverConnPool.snapshot()
+	if n <= 0 || len(conns) <= n {
+		return 0
+	}
+	// The pool keeps connections in the order they joined.
+	if s.EvictionPolicy == EvictIdlest {
+		sort.SliceStable(conns, func(i, j int) bool {
+			return conns[i].lastActivity.Load() > conns[j].lastActivity.Load()
+		})
+	}
+	for _, conn := range conns[n:] {
+		// The connection may have left on its own in the meantime.
+		if !conn.markClosed() {
+			continue
+		}
+		s.logger.Println(conn.t.RemoteAddr(), "Client connection evicted: Connection limit lowered to", n)
+		// The connection is closed right after, a notice queued for an ack would never go out.
+		conn.reply(s.localize(conn.locale, Message{Type: MessageTypeMaintenance, Body: "The chat server is reducing its connections, try again later.", Reason: ReasonEvicted}))
+		s.dropConn(conn)
+		evicted++
+	}
+	return evicted
+}
+
+// Returns the connection limit set by SetMaxConnections, zero means no limit.
+func (s *ChatServer) MaxConnections() int {
+	return int(s.maxConns.Load())
+}
+
+// Returns the time the chat server started running, or the zero time if Run has not been called.
+func (s *ChatServer) StartedAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.startedAt
+}
+
+// Returns how long the chat server has been running, or zero if Run has not been called.
+func (s *ChatServer) Uptime() time.Duration {
+	startedAt := s.StartedAt()
+	if startedAt.IsZero() {
+		return 0
+	}
+	return s.clock().Now().Sub(startedAt)
+}
+
+// Gracefully stops the chat server.
+// The notice is broadcast to every client first as a maintenance message with ReasonShutdown,
+// translated by the Localizer, then new connections are refused.
+// Clients get DrainGracePeriod to disconnect on their own, the rest are force-closed.
+// If ctx is done before the grace period ends, the remaining clients are force-closed and ctx.Err() is returned.
+// When it returns, the connection pool is stopped and empty.
+func (s *ChatServer) DrainAndStop(ctx context.Context, notice string) error {
+	grace := s.DrainGracePeriod
+	if grace <= 0 {
+		grace = defaultDrainGracePeriod
+	}
+	return s.stop(ctx, notice, grace)
+}
+
+// Stops the chat server without a notice, new connections are refused at once.
+// Clients get the grace period to disconnect on their own, the rest are force-closed once it is over,
+// zero force-closes them right away. ctx is the hard deadline: if it is done before the grace period ends,
+// the remaining clients are force-closed and ctx.Err() is returned.
+// When it returns, the connection pool is stopped and empty.
+func (s *ChatServer) Stop(ctx context.Context, grace time.Duration) error {
+	return s.stop(ctx, "", grace)
+}
+
+// Stops the chat server, see DrainAndStop. An empty notice is not broadcast.
+func (s *ChatServer) stop(ctx context.Context, notice string, grace time.Duration) error {
+	s.mu.Lock()
+	server := s.httpServer
+	s.httpServer = nil
+	s.mu.Unlock()
+	if server == nil {
+		return errors.New("chat server is not running")
+	}
+	// Stopping the pool force-closes whoever is left.
+	defer s.stopPool()
+	if notice != "" {
+		// Sent as a maintenance notice, so clients know the server is going away and not take it for chat.
+		if err := s.broadcastFrom(nil, Message{Type: MessageTypeMaintenance, Body: notice, Reason: ReasonShutdown}); err != nil {
+			s.logger.Println("Can not broadcast shutdown notice:", err)
+		}
+	}
+	// Stop accepting new connections, WebSocket connections are hijacked so Shutdown does not wait for them.
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+	if grace <= 0 {
+		return nil
 	}
+	graceOver := s.clock().After(grace)
+	for len(s.serverConnPool.snapshot()) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-graceOver:
+			return nil
+		case <-s.clock().After(100 * time.Millisecond):
+		}
+	}
+	return nil
 }
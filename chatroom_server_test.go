@@ -0,0 +1,1551 @@
+package chatroom
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// A logBuffer collects server log output, it is safe to read while the server writes to it.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// A failingTransport fails every Send, its Receive blocks until it is closed.
+type failingTransport struct {
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFailingTransport() *failingTransport {
+	return &failingTransport{closed: make(chan struct{})}
+}
+
+func (f *failingTransport) Send(Message) error {
+	return errors.New("write failed")
+}
+
+func (f *failingTransport) Receive() (Message, error) {
+	<-f.closed
+	return Message{}, io.EOF
+}
+
+func (f *failingTransport) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *failingTransport) RemoteAddr() string {
+	return "failing"
+}
+
+// Returns a chat server that discards its log output.
+func newTestServer(password string) *ChatServer {
+	s := NewChatServer("", password)
+	s.SetLogOutput(io.Discard)
+	return s
+}
+
+// Runs s on a free local port with its own mux until the test ends, returns the URL clients register with.
+func startServer(t *testing.T, s *ChatServer) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listenAddr = listener.Addr().String()
+	listener.Close()
+	go s.run(http.NewServeMux())
+	t.Cleanup(func() {
+		s.mu.Lock()
+		server := s.httpServer
+		s.httpServer = nil
+		s.mu.Unlock()
+		if server != nil {
+			server.Close()
+		}
+		s.stopPool()
+	})
+	waitUntil(t, func() bool { return !s.StartedAt().IsZero() })
+	scheme := "ws"
+	if s.TLSConfig != nil {
+		scheme = "wss"
+	}
+	return scheme + "://" + s.listenAddr + "/register"
+}
+
+// Registers a client with the server at url, setup can configure it before it registers.
+func connect(t *testing.T, url, protocol, password string, setup func(c *ChatClient)) *ChatClient {
+	t.Helper()
+	sc, err := NewServerConfig("http://localhost/", protocol, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChatClient("", sc)
+	if setup != nil {
+		setup(c)
+	}
+	c.Register(password)
+	t.Cleanup(func() { c.activeConn().Close() })
+	return c
+}
+
+// Serves one end of a pipe on s until the test ends and returns the client end.
+func servePipe(t *testing.T, s *ChatServer) Transport {
+	t.Helper()
+	client, server := NewPipe()
+	go s.ServeTransport(server)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Receives the next message from the transport, failing the test if none arrives in time.
+func receive(t *testing.T, tr Transport) Message {
+	t.Helper()
+	type result struct {
+		message Message
+		err     error
+	}
+	received := make(chan result, 1)
+	go func() {
+		message, err := tr.Receive()
+		received <- result{message, err}
+	}()
+	select {
+	case r := <-received:
+		if r.err != nil {
+			t.Fatalf("receive: %v", r.err)
+		}
+		return r.message
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return Message{}
+}
+
+// Polls cond until it holds, failing the test if it does not within a few seconds.
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Waits until the server's pool holds n connections.
+func waitConns(t *testing.T, s *ChatServer, n int) {
+	t.Helper()
+	waitUntil(t, func() bool { return len(s.serverConnPool.snapshot()) == n })
+}
+
+func TestDrainAndStopNotifiesClientsBeforeClosing(t *testing.T) {
+	s := newTestServer("")
+	s.DrainGracePeriod = 100 * time.Millisecond
+	s.Localizer = mapLocalizer{"fr": {"Server is shutting down.": "Le serveur s'arrête."}}
+	url := startServer(t, s)
+	clients := []*ChatClient{
+		connect(t, url, "", "", nil),
+		connect(t, url, JSONProtocol, "", nil),
+		connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.Locale = "fr" }),
+	}
+	waitConns(t, s, 3)
+
+	done := make(chan error, 1)
+	go func() { done <- s.DrainAndStop(context.Background(), "Server is shutting down.") }()
+
+	if message, err := clients[0].Read(); err != nil || message != "Server is shutting down." {
+		t.Fatalf("text client got %q, %v", message, err)
+	}
+	for i, want := range map[int]string{1: "Server is shutting down.", 2: "Le serveur s'arrête."} {
+		message, err := clients[i].ReadJSON()
+		if !errors.Is(err, ErrMaintenance) || message.Type != MessageTypeMaintenance || message.Reason != ReasonShutdown || message.Body != want {
+			t.Fatalf("JSON client %d got %+v, %v, want the maintenance notice %q", i, message, err, want)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("DrainAndStop: %v", err)
+	}
+	if _, err := clients[0].Read(); err == nil {
+		t.Fatal("connection still open after DrainAndStop")
+	}
+	if n := len(s.serverConnPool.snapshot()); n != 0 {
+		t.Fatalf("%d connections left after DrainAndStop", n)
+	}
+}
+
+func TestDrainAndStopRespectsContext(t *testing.T) {
+	s := newTestServer("")
+	s.DrainGracePeriod = time.Minute
+	url := startServer(t, s)
+	c := connect(t, url, "", "", nil)
+	waitConns(t, s, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.DrainAndStop(ctx, "bye") }()
+	if message, err := c.Read(); err != nil || message != "bye" {
+		t.Fatalf("got %q, %v", message, err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("DrainAndStop returned %v, want the context error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DrainAndStop ignored the context deadline")
+	}
+	if _, err := c.Read(); err == nil {
+		t.Fatal("client was not force-closed")
+	}
+}
+
+func TestDrainAndStopWhenNotRunning(t *testing.T) {
+	if err := newTestServer("").DrainAndStop(context.Background(), "bye"); err == nil {
+		t.Fatal("DrainAndStop on a server that is not running succeeded")
+	}
+}
+
+func TestStopForceClosesAfterGrace(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	c := connect(t, url, "", "", nil)
+	waitConns(t, s, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := s.Stop(ctx, 50*time.Millisecond); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("Stop took %v, the grace period was 50ms", elapsed)
+	}
+	if _, err := c.Read(); err == nil {
+		t.Fatal("client was not force-closed after the grace period")
+	}
+	if n := len(s.serverConnPool.snapshot()); n != 0 {
+		t.Fatalf("%d connections left after Stop", n)
+	}
+}
+
+func TestStopWithoutGraceClosesAtOnce(t *testing.T) {
+	s := newTestServer("")
+	s.Clock = newFakeClock()
+	url := startServer(t, s)
+	c := connect(t, url, "", "", nil)
+	waitConns(t, s, 1)
+
+	// The clock never moves, so Stop only returns if it does not wait on it.
+	if err := s.Stop(context.Background(), 0); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if _, err := c.Read(); err == nil {
+		t.Fatal("client was not force-closed")
+	}
+}
+
+func TestStartedAtAndUptime(t *testing.T) {
+	s := newTestServer("")
+	if !s.StartedAt().IsZero() || s.Uptime() != 0 {
+		t.Fatal("a server that has not run reports a start time")
+	}
+	before := time.Now()
+	startServer(t, s)
+	if startedAt := s.StartedAt(); startedAt.Before(before) || startedAt.After(time.Now()) {
+		t.Fatalf("StartedAt %v is not when the server started", startedAt)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if uptime := s.Uptime(); uptime < 10*time.Millisecond {
+		t.Fatalf("Uptime %v is too short", uptime)
+	}
+}
+
+func TestBroadcastToJustClosedConnectionIsQuiet(t *testing.T) {
+	s := newTestServer("")
+	logs := new(logBuffer)
+	s.SetLogOutput(logs)
+	s.LogPoolChanges = true
+	client := servePipe(t, s)
+	waitConns(t, s, 1)
+	conn := s.serverConnPool.snapshot()[0]
+
+	client.Close()
+	waitUntil(t, func() bool { return conn.closed.Load() })
+	if err := s.Broadcast("hello"); err != nil {
+		t.Fatalf("Broadcast to a closed connection returned %v", err)
+	}
+	waitConns(t, s, 0)
+	if err := s.Broadcast("hello"); err != nil {
+		t.Fatalf("Broadcast to an empty pool returned %v", err)
+	}
+	if n := strings.Count(logs.String(), "unregister"); n != 1 {
+		t.Fatalf("connection unregistered %d times:\n%s", n, logs)
+	}
+}
+
+func TestBroadcastContinuesPastFailedConnection(t *testing.T) {
+	s := newTestServer("")
+	failing := newFailingTransport()
+	go s.ServeTransport(failing)
+	waitConns(t, s, 1)
+	client := servePipe(t, s)
+	waitConns(t, s, 2)
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.Broadcast("hello") }()
+	if message := receive(t, client); message.Body != "hello" {
+		t.Fatalf("got %+v", message)
+	}
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "failing") {
+		t.Fatalf("Broadcast returned %v, want the failed connection's error", err)
+	}
+	waitConns(t, s, 1)
+}
+
+func TestEachClientGetsItsNegotiatedFormat(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	text := connect(t, url, TextProtocol, "", nil)
+	plain := connect(t, url, "", "", nil)
+	json := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 3)
+
+	if err := s.Broadcast("hi"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*ChatClient{text, plain} {
+		if message, err := c.Read(); err != nil || message != "hi" {
+			t.Fatalf("text client got %q, %v", message, err)
+		}
+	}
+	if message, err := json.ReadJSON(); err != nil || message.Type != MessageTypeChat || message.Body != "hi" {
+		t.Fatalf("JSON client got %+v, %v", message, err)
+	}
+}
+
+func TestTextHeartbeatIsNotBroadcast(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	sender := connect(t, url, "", "", nil)
+	receiver := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 2)
+
+	sender.Send(textHeartbeat)
+	sender.Send("hello")
+	message, err := receiver.ReadJSON()
+	if err != nil || message.Body != "hello" {
+		t.Fatalf("got %+v, %v", message, err)
+	}
+	if message.Seq != 1 {
+		t.Fatalf("heartbeat used up a sequence number, got seq %d", message.Seq)
+	}
+}
+
+func TestPoolChangesAreNotLoggedByDefault(t *testing.T) {
+	s := newTestServer("")
+	logs := new(logBuffer)
+	s.SetLogOutput(logs)
+	client := servePipe(t, s)
+	waitConns(t, s, 1)
+	client.Close()
+	waitConns(t, s, 0)
+	if strings.Contains(logs.String(), "Connections:") {
+		t.Fatalf("pool changes logged without LogPoolChanges:\n%s", logs)
+	}
+}
+
+func TestPoolChangeLoggingIsRateLimited(t *testing.T) {
+	s := newTestServer("")
+	logs := new(logBuffer)
+	s.SetLogOutput(logs)
+	clock := newFakeClock()
+	s.Clock = clock
+	s.LogPoolChanges = true
+	s.PoolLogInterval = time.Minute
+
+	servePipe(t, s)
+	waitConns(t, s, 1)
+	servePipe(t, s)
+	waitConns(t, s, 2)
+	servePipe(t, s)
+	waitConns(t, s, 3)
+	if n := strings.Count(logs.String(), "Connections:"); n != 1 {
+		t.Fatalf("%d pool changes logged within the interval:\n%s", n, logs)
+	}
+	if !strings.Contains(logs.String(), "register. Connections: 1") {
+		t.Fatalf("first change not logged with the pool size:\n%s", logs)
+	}
+
+	clock.Advance(time.Minute)
+	servePipe(t, s)
+	waitConns(t, s, 4)
+	if !strings.Contains(logs.String(), "Connections: 4 Changes not logged: 2") {
+		t.Fatalf("skipped changes not reported:\n%s", logs)
+	}
+}
+
+func TestListenerReceivesButCanNotSend(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	listener := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.Listener = true })
+	other := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 2)
+
+	if err := listener.SendJSON(Message{Body: "from listener"}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := listener.ReadJSON(); err != nil || message.Type != MessageTypeError {
+		t.Fatalf("listener got %+v, %v, want an error", message, err)
+	}
+	if err := other.SendJSON(Message{Body: "from user"}); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := listener.ReadJSON(); err != nil || message.Body != "from user" {
+		t.Fatalf("listener got %+v, %v", message, err)
+	}
+	s.Broadcast("from server")
+	if message, err := other.ReadJSON(); err != nil || message.Body != "from server" {
+		t.Fatalf("the listener's message was broadcast, got %+v, %v", message, err)
+	}
+	var info ConnectionInfo
+	s.ForEachConnection(func(i ConnectionInfo) bool {
+		if i.Listener {
+			info = i
+		}
+		return true
+	})
+	if !info.Listener {
+		t.Fatal("listener not reported in ConnectionInfo")
+	}
+}
+
+func TestEchoIsOptIn(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	echo := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.Echo = true })
+	quiet := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 2)
+
+	echo.SendJSON(Message{Body: "from echo"})
+	if message, err := echo.ReadJSON(); err != nil || message.Body != "from echo" {
+		t.Fatalf("echo client got %+v, %v", message, err)
+	}
+	if message, err := quiet.ReadJSON(); err != nil || message.Body != "from echo" {
+		t.Fatalf("other client got %+v, %v", message, err)
+	}
+	quiet.SendJSON(Message{Body: "from quiet"})
+	if message, err := echo.ReadJSON(); err != nil || message.Body != "from quiet" {
+		t.Fatalf("echo client got %+v, %v", message, err)
+	}
+	s.Broadcast("from server")
+	if message, err := quiet.ReadJSON(); err != nil || message.Body != "from server" {
+		t.Fatalf("client without echo got its own message back: %+v, %v", message, err)
+	}
+}
+
+// A brokenTransport fails its first Receive as if the connection was reset.
+type brokenTransport struct {
+	*failingTransport
+}
+
+func (b brokenTransport) Receive() (Message, error) {
+	return Message{}, errors.New("connection reset by peer")
+}
+
+func TestCleanCloseIsNotLoggedAsError(t *testing.T) {
+	s := newTestServer("")
+	logs := new(logBuffer)
+	s.SetLogOutput(logs)
+	url := startServer(t, s)
+	c := connect(t, url, "", "", nil)
+	waitConns(t, s, 1)
+	c.activeConn().Close()
+	waitConns(t, s, 0)
+	waitUntil(t, func() bool { return strings.Contains(logs.String(), "disconnected.") })
+	if strings.Contains(logs.String(), "connection error") {
+		t.Fatalf("clean close logged as an error:\n%s", logs)
+	}
+
+	s.ServeTransport(brokenTransport{newFailingTransport()})
+	if !strings.Contains(logs.String(), "failing connection error: connection reset by peer") {
+		t.Fatalf("abnormal termination not logged as an error:\n%s", logs)
+	}
+}
+
+func TestStalledWriteTimesOutAndDropsConnection(t *testing.T) {
+	s := newTestServer("")
+	logs := new(logBuffer)
+	s.SetLogOutput(logs)
+	s.WriteTimeout = 100 * time.Millisecond
+	url := startServer(t, s)
+	connect(t, url, "", "", nil)
+	waitConns(t, s, 1)
+
+	// The client never reads, so the socket buffers fill up and a write stalls.
+	payload := strings.Repeat("x", 1<<20)
+	var err error
+	for i := 0; i < 200 && err == nil; i++ {
+		err = s.Broadcast(payload)
+	}
+	if err == nil {
+		t.Fatal("writes to a stalled client never failed")
+	}
+	waitConns(t, s, 0)
+	// Dropping the connection closes it, which also ends its reader.
+	waitUntil(t, func() bool { return strings.Contains(logs.String(), "connection error") })
+}
+
+func TestPasswordsGrantRoles(t *testing.T) {
+	s := newTestServer("")
+	s.Passwords = map[string]string{"user-secret": RoleUser, "admin-secret": RoleAdmin}
+	url := startServer(t, s)
+	connect(t, url, "", "user-secret", nil)
+	waitConns(t, s, 1)
+	connect(t, url, "", "admin-secret", nil)
+	waitConns(t, s, 2)
+	rejected := connect(t, url, "", "wrong", nil)
+	if message, err := rejected.Read(); err != nil || message != "Incorrect password." {
+		t.Fatalf("got %q, %v, want the incorrect password error", message, err)
+	}
+	if _, err := rejected.Read(); err == nil {
+		t.Fatal("a wrong password was accepted")
+	}
+
+	roles := map[string]int{}
+	s.ForEachConnection(func(info ConnectionInfo) bool {
+		roles[info.Role]++
+		return true
+	})
+	if len(roles) != 2 || roles[RoleUser] != 1 || roles[RoleAdmin] != 1 {
+		t.Fatalf("got roles %v", roles)
+	}
+}
+
+func TestSinglePasswordGrantsUserRole(t *testing.T) {
+	s := newTestServer("secret")
+	url := startServer(t, s)
+	connect(t, url, "", "secret", nil)
+	waitConns(t, s, 1)
+	rejected := connect(t, url, "", "", nil)
+	rejected.Read()
+	if _, err := rejected.Read(); err == nil {
+		t.Fatal("a missing password was accepted")
+	}
+	s.ForEachConnection(func(info ConnectionInfo) bool {
+		if info.Role != RoleUser {
+			t.Fatalf("got role %q", info.Role)
+		}
+		return true
+	})
+}
+
+func TestBadFramesAreToleratedUpToALimit(t *testing.T) {
+	s := newTestServer("")
+	s.MaxBadFrames = 2
+	url := startServer(t, s)
+	c := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.Echo = true })
+	waitConns(t, s, 1)
+	sendRaw := func(data string) {
+		t.Helper()
+		if err := websocket.Message.Send(c.activeConn(), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sendRaw("not json")
+	if message, err := c.ReadJSON(); err != nil || message.Reason != ReasonBadFrame {
+		t.Fatalf("got %+v, %v, want a bad_frame error", message, err)
+	}
+	c.SendJSON(Message{Body: "still here"})
+	if message, err := c.ReadJSON(); err != nil || message.Body != "still here" {
+		t.Fatalf("got %+v, %v", message, err)
+	}
+	for i := 0; i < s.MaxBadFrames; i++ {
+		sendRaw("not json")
+		if message, err := c.ReadJSON(); err != nil || message.Reason != ReasonBadFrame {
+			t.Fatalf("got %+v, %v, want a bad_frame error", message, err)
+		}
+	}
+	sendRaw("not json")
+	waitConns(t, s, 0)
+}
+
+func TestStoppingThePoolClosesConnections(t *testing.T) {
+	s := newTestServer("")
+	clients := []Transport{servePipe(t, s), servePipe(t, s)}
+	waitConns(t, s, 2)
+
+	s.stopPool()
+	select {
+	case <-s.serverConnPool.stopped:
+	default:
+		t.Fatal("pool loop still running after stop")
+	}
+	for _, client := range clients {
+		if _, err := client.Receive(); !errors.Is(err, io.EOF) {
+			t.Fatalf("connection still open after stop: %v", err)
+		}
+	}
+	if n := len(s.serverConnPool.snapshot()); n != 0 {
+		t.Fatalf("%d connections left in a stopped pool", n)
+	}
+
+	late, server := NewPipe()
+	done := make(chan struct{})
+	go func() {
+		s.ServeTransport(server)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stopped pool accepted a connection")
+	}
+	if _, err := late.Receive(); !errors.Is(err, io.EOF) {
+		t.Fatalf("late connection left open: %v", err)
+	}
+}
+
+func TestConnectAndMessageHooksShareContext(t *testing.T) {
+	s := newTestServer("")
+	type call struct {
+		ctx     *ConnContext
+		value   any
+		message Message
+	}
+	connects := make(chan *ConnContext, 1)
+	messages := make(chan call, 1)
+	s.OnConnect = func(ctx *ConnContext) {
+		ctx.Set("origin", ctx.Request.Header.Get("Origin"))
+		connects <- ctx
+	}
+	s.OnMessage = func(ctx *ConnContext, message Message) {
+		value, _ := ctx.Get("origin")
+		messages <- call{ctx, value, message}
+	}
+	url := startServer(t, s)
+	c := connect(t, url, JSONProtocol, "", nil)
+	ctx := <-connects
+	if ctx.ID == "" {
+		t.Fatal("connection has no ID")
+	}
+
+	c.SendJSON(Message{Body: "hello"})
+	got := <-messages
+	if got.ctx != ctx || got.value != "http://localhost/" || got.message.Body != "hello" {
+		t.Fatalf("OnMessage got %+v", got)
+	}
+	if _, ok := ctx.Get("missing"); ok {
+		t.Fatal("Get found a value that was never set")
+	}
+}
+
+func TestRepeatedMessagesAreThrottled(t *testing.T) {
+	s := newTestServer("")
+	clock := newFakeClock()
+	s.Clock = clock
+	s.DuplicateLimit = 2
+	sender := servePipe(t, s)
+	receiver := servePipe(t, s)
+	waitConns(t, s, 2)
+	broadcast := func(body string) {
+		t.Helper()
+		sender.Send(Message{Type: MessageTypeChat, Body: body})
+		if message := receive(t, receiver); message.Body != body {
+			t.Fatalf("got %+v, want %q broadcast", message, body)
+		}
+	}
+	throttled := func(body string) {
+		t.Helper()
+		sender.Send(Message{Type: MessageTypeChat, Body: body})
+		if message := receive(t, sender); message.Reason != ReasonDuplicate {
+			t.Fatalf("got %+v, want %q throttled", message, body)
+		}
+	}
+
+	// Without DuplicateWindow the default window applies, and repeats count even when interleaved.
+	broadcast("spam")
+	broadcast("other")
+	broadcast("spam")
+	broadcast("more")
+	throttled("spam")
+	broadcast("other")
+	throttled("other")
+	broadcast("varied")
+
+	clock.Advance(defaultDuplicateWindow)
+	broadcast("spam")
+}
+
+func TestUnknownTypePolicy(t *testing.T) {
+	custom := Message{Type: "custom", Body: "payload"}
+	setup := func(t *testing.T, policy UnknownTypePolicy) (sender, receiver Transport) {
+		s := newTestServer("")
+		s.UnknownTypePolicy = policy
+		sender = servePipe(t, s)
+		receiver = servePipe(t, s)
+		waitConns(t, s, 2)
+		sender.Send(custom)
+		return sender, receiver
+	}
+	t.Run("ignore", func(t *testing.T) {
+		sender, receiver := setup(t, UnknownTypeIgnore)
+		sender.Send(Message{Type: MessageTypeChat, Body: "next"})
+		if message := receive(t, receiver); message.Body != "next" {
+			t.Fatalf("got %+v, want the unknown type dropped", message)
+		}
+	})
+	t.Run("error", func(t *testing.T) {
+		sender, _ := setup(t, UnknownTypeError)
+		if message := receive(t, sender); message.Reason != ReasonUnknownType {
+			t.Fatalf("got %+v, want an unknown_type error", message)
+		}
+	})
+	t.Run("broadcast", func(t *testing.T) {
+		_, receiver := setup(t, UnknownTypeBroadcast)
+		if message := receive(t, receiver); message.Type != custom.Type || message.Body != custom.Body {
+			t.Fatalf("got %+v, want the message unchanged", message)
+		}
+	})
+}
+
+func TestServerOnlyTypesAreRefused(t *testing.T) {
+	for _, policy := range []UnknownTypePolicy{UnknownTypeIgnore, UnknownTypeError, UnknownTypeBroadcast} {
+		s := newTestServer("")
+		s.UnknownTypePolicy = policy
+		sender := servePipe(t, s)
+		receiver := servePipe(t, s)
+		waitConns(t, s, 2)
+		for _, forged := range []string{MessageTypeError, MessageTypeSystem, MessageTypeMaintenance} {
+			sender.Send(Message{Type: forged, Body: "The chat server is going away."})
+			if message := receive(t, sender); message.Type != MessageTypeError || message.Reason != ReasonReservedType {
+				t.Fatalf("policy %d, type %s: got %+v, want a reserved_type error", policy, forged, message)
+			}
+		}
+		sender.Send(Message{Body: "next"})
+		if message := receive(t, receiver); message.Body != "next" {
+			t.Fatalf("policy %d: got %+v, want the forged messages dropped", policy, message)
+		}
+	}
+}
+
+func TestSetLogOutput(t *testing.T) {
+	s := newTestServer("")
+	first, second := new(logBuffer), new(logBuffer)
+	s.SetLogOutput(first)
+	s.LogPoolChanges = true
+	client := servePipe(t, s)
+	waitConns(t, s, 1)
+	s.SetLogOutput(second)
+	client.Close()
+	waitConns(t, s, 0)
+	if !strings.Contains(first.String(), "register.") || strings.Contains(first.String(), "unregister.") {
+		t.Fatalf("first writer got:\n%s", first)
+	}
+	waitUntil(t, func() bool { return strings.Contains(second.String(), "unregister.") })
+}
+
+func TestForEachConnection(t *testing.T) {
+	s := newTestServer("")
+	for i := 0; i < 3; i++ {
+		servePipe(t, s)
+	}
+	waitConns(t, s, 3)
+
+	ids := map[string]bool{}
+	s.ForEachConnection(func(info ConnectionInfo) bool {
+		ids[info.ID] = true
+		if info.Role != RoleUser || info.RemoteAddr != "pipe-b" {
+			t.Fatalf("got %+v", info)
+		}
+		return true
+	})
+	if len(ids) != 3 {
+		t.Fatalf("visited %d distinct connections", len(ids))
+	}
+	visited := 0
+	s.ForEachConnection(func(ConnectionInfo) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Fatalf("iteration went on after fn returned false, visited %d", visited)
+	}
+}
+
+func TestClientIDIsSentAndChecked(t *testing.T) {
+	s := newTestServer("")
+	s.RequireClientID = true
+	s.ClientIDPattern = regexp.MustCompile(`^[a-z]+$`)
+	url := startServer(t, s)
+	withID := func(id string) func(*ChatClient) {
+		return func(c *ChatClient) { c.ClientID = id }
+	}
+
+	missing := connect(t, url, JSONProtocol, "", nil)
+	if message, err := missing.ReadJSON(); err != nil || message.Reason != ReasonClientIDRequired {
+		t.Fatalf("got %+v, %v, want client_id_required", message, err)
+	}
+	invalid := connect(t, url, JSONProtocol, "", withID("Not Valid!"))
+	if message, err := invalid.ReadJSON(); err != nil || message.Reason != ReasonInvalidClientID {
+		t.Fatalf("got %+v, %v, want invalid_client_id", message, err)
+	}
+	connect(t, url, JSONProtocol, "", withID("alice"))
+	waitConns(t, s, 1)
+	s.ForEachConnection(func(info ConnectionInfo) bool {
+		if info.ClientID != "alice" {
+			t.Fatalf("registered with ClientID %q", info.ClientID)
+		}
+		return true
+	})
+}
+
+func TestEmptyMessagesAreSkipped(t *testing.T) {
+	s := newTestServer("")
+	sender := servePipe(t, s)
+	receiver := servePipe(t, s)
+	waitConns(t, s, 2)
+
+	sender.Send(Message{Type: MessageTypeChat})
+	sender.Send(Message{})
+	sender.Send(Message{Type: MessageTypeChat, Body: "not empty"})
+	if message := receive(t, receiver); message.Body != "not empty" {
+		t.Fatalf("got %+v, want the empty messages skipped", message)
+	}
+}
+
+func TestNormalizeWhitespace(t *testing.T) {
+	tests := []struct {
+		body, single, multi string
+	}{
+		{"  hello   world \t", "hello world", "hello world"},
+		{"line one  \n\n   line   two\n", "line one line two", "line one\nline two"},
+		{" \n\t ", "", ""},
+	}
+	for _, test := range tests {
+		if got := normalizeWhitespace(test.body, false); got != test.single {
+			t.Errorf("normalizeWhitespace(%q, false) = %q, want %q", test.body, got, test.single)
+		}
+		if got := normalizeWhitespace(test.body, true); got != test.multi {
+			t.Errorf("normalizeWhitespace(%q, true) = %q, want %q", test.body, got, test.multi)
+		}
+	}
+}
+
+func TestMessagesAreNormalizedBeforeBroadcast(t *testing.T) {
+	s := newTestServer("")
+	s.NormalizeWhitespace = true
+	sender := servePipe(t, s)
+	receiver := servePipe(t, s)
+	waitConns(t, s, 2)
+
+	sender.Send(Message{Type: MessageTypeChat, Body: "   \n  "})
+	sender.Send(Message{Type: MessageTypeChat, Body: "  spaced    out  "})
+	if message := receive(t, receiver); message.Body != "spaced out" {
+		t.Fatalf("got %+v, want the blank message skipped and the next one normalized", message)
+	}
+	sender.Send(Message{Type: "custom", Body: "  untouched  "})
+	sender.Send(Message{Type: MessageTypeChat, Body: "next"})
+	if message := receive(t, receiver); message.Body != "next" {
+		t.Fatalf("got %+v", message)
+	}
+}
+
+func TestPushTargetsOneConnection(t *testing.T) {
+	s := newTestServer("")
+	ids := make(chan string, 2)
+	s.OnConnect = func(ctx *ConnContext) { ids <- ctx.ID }
+	target := servePipe(t, s)
+	targetID := <-ids
+	other := servePipe(t, s)
+	<-ids
+	waitConns(t, s, 2)
+
+	pushed := make(chan error, 1)
+	go func() { pushed <- s.Push(targetID, Message{Type: MessageTypeSystem, Body: "just you"}) }()
+	if message := receive(t, target); message.Body != "just you" {
+		t.Fatalf("got %+v", message)
+	}
+	if err := <-pushed; err != nil {
+		t.Fatal(err)
+	}
+	go s.Broadcast("everyone")
+	if message := receive(t, target); message.Body != "everyone" {
+		t.Fatalf("the target got %+v after the push", message)
+	}
+	if message := receive(t, other); message.Body != "everyone" {
+		t.Fatalf("the other connection got %+v", message)
+	}
+	if err := s.Push("unknown", Message{Body: "nobody"}); err == nil {
+		t.Fatal("Push to an unknown connection succeeded")
+	}
+
+	failing := newFailingTransport()
+	go s.ServeTransport(failing)
+	failingID := <-ids
+	waitConns(t, s, 3)
+	if err := s.Push(failingID, Message{Body: "lost"}); err == nil {
+		t.Fatal("a failed Push returned no error")
+	}
+	waitConns(t, s, 2)
+	select {
+	case <-failing.closed:
+	default:
+		t.Fatal("connection left open after a failed Push")
+	}
+}
+
+func TestSequenceNumbersAreGapFreeAndOrdered(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	receiver := connect(t, url, JSONProtocol, "", nil)
+	senders := []*ChatClient{
+		connect(t, url, JSONProtocol, "", nil),
+		connect(t, url, JSONProtocol, "", nil),
+	}
+	waitConns(t, s, 3)
+
+	const perSender = 20
+	for _, sender := range senders {
+		go func(sender *ChatClient) {
+			for i := 0; i < perSender; i++ {
+				sender.SendJSON(Message{Body: "message " + strconv.Itoa(i)})
+			}
+		}(sender)
+		go func(sender *ChatClient) {
+			for {
+				if _, err := sender.ReadJSON(); err != nil {
+					return
+				}
+			}
+		}(sender)
+	}
+	for want := uint64(1); want <= 2*perSender; want++ {
+		message, err := receiver.ReadJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Seq != want {
+			t.Fatalf("got seq %d, want %d", message.Seq, want)
+		}
+	}
+}
+
+func TestServesWithTCPKeepAliveSettings(t *testing.T) {
+	for _, keepAlive := range []time.Duration{-1, time.Second} {
+		s := newTestServer("")
+		s.TCPKeepAlive = keepAlive
+		url := startServer(t, s)
+		c := connect(t, url, "", "", nil)
+		waitConns(t, s, 1)
+		s.Broadcast("hello")
+		if message, err := c.Read(); err != nil || message != "hello" {
+			t.Fatalf("TCPKeepAlive %v: got %q, %v", keepAlive, message, err)
+		}
+	}
+}
+
+func TestWelcomeBannerIsSentOnce(t *testing.T) {
+	for _, banner := range []string{"Welcome!", ""} {
+		s := newTestServer("")
+		s.WelcomeBanner = banner
+		client := servePipe(t, s)
+		if banner != "" {
+			if message := receive(t, client); message.Type != MessageTypeSystem || message.Body != banner {
+				t.Fatalf("first message was %+v, want the banner", message)
+			}
+		}
+		waitConns(t, s, 1)
+		go s.Broadcast("next")
+		if message := receive(t, client); message.Type != MessageTypeChat || message.Body != "next" {
+			t.Fatalf("banner %q: got %+v after it, want the broadcast", banner, message)
+		}
+		s.stopPool()
+	}
+}
+
+func TestSetAcceptingConnections(t *testing.T) {
+	s := newTestServer("")
+	sender := servePipe(t, s)
+	receiver := servePipe(t, s)
+	waitConns(t, s, 2)
+
+	s.SetAcceptingConnections(false)
+	if message := receive(t, servePipe(t, s)); message.Type != MessageTypeMaintenance {
+		t.Fatalf("a new connection got %+v, want a maintenance notice", message)
+	}
+	if err := sender.Send(Message{Type: MessageTypeChat, Body: "still here"}); err != nil {
+		t.Fatal(err)
+	}
+	if message := receive(t, receiver); message.Body != "still here" {
+		t.Fatalf("got %+v", message)
+	}
+	if n := len(s.serverConnPool.snapshot()); n != 2 {
+		t.Fatalf("%d connections while not accepting, want 2", n)
+	}
+
+	s.SetAcceptingConnections(true)
+	servePipe(t, s)
+	waitConns(t, s, 3)
+}
+
+func TestDeliverySeqCountsPerConnection(t *testing.T) {
+	s := newTestServer("")
+	s.UnknownTypePolicy = UnknownTypeError
+	// Broadcasts reach the connections in the order they joined.
+	sender := servePipe(t, s)
+	waitConns(t, s, 1)
+	receiver := servePipe(t, s)
+	waitConns(t, s, 2)
+
+	go s.Broadcast("one")
+	receive(t, sender)
+	receive(t, receiver)
+	go sender.Send(Message{Type: MessageTypeChat, Body: "hi"})
+	if message := receive(t, receiver); message.Body != "hi" || message.DeliverySeq != 2 {
+		t.Fatalf("receiver got %+v, want delivery_seq 2", message)
+	}
+	// The error only goes to the sender, which did not get its own message back.
+	go sender.Send(Message{Type: "shout"})
+	if message := receive(t, sender); message.Type != MessageTypeError || message.DeliverySeq != 2 {
+		t.Fatalf("sender got %+v, want delivery_seq 2", message)
+	}
+	go s.Broadcast("two")
+	if message := receive(t, sender); message.DeliverySeq != 3 {
+		t.Fatalf("sender got %+v, want delivery_seq 3", message)
+	}
+	if message := receive(t, receiver); message.DeliverySeq != 3 {
+		t.Fatalf("receiver got %+v, want delivery_seq 3", message)
+	}
+}
+
+func TestAuthHooks(t *testing.T) {
+	s := newTestServer("secret")
+	s.ClientIDPattern = regexp.MustCompile(`^[a-z]+$`)
+	type event struct {
+		id, detail, remoteAddr string
+	}
+	events := make(chan event, 1)
+	s.OnAuthSuccess = func(r *http.Request, clientID string) {
+		events <- event{r.URL.Query().Get("id"), "ok " + clientID, r.RemoteAddr}
+	}
+	s.OnAuthFailure = func(r *http.Request, reason string) {
+		events <- event{r.URL.Query().Get("id"), reason, r.RemoteAddr}
+	}
+	url := startServer(t, s)
+
+	for _, tc := range []struct {
+		id, password, want string
+	}{
+		{"alice", "secret", "ok alice"},
+		{"bob", "wrong", ReasonIncorrectPassword},
+		{"Bob!", "secret", ReasonInvalidClientID},
+	} {
+		connect(t, url, "", tc.password, func(c *ChatClient) { c.ClientID = tc.id })
+		if e := <-events; e.id != tc.id || e.detail != tc.want || e.remoteAddr == "" {
+			t.Fatalf("%s with %q: got %+v, want %q", tc.id, tc.password, e, tc.want)
+		}
+	}
+}
+
+func TestBroadcastSync(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	clients := []*ChatClient{
+		connect(t, url, "", "", nil),
+		connect(t, url, "", "", nil),
+		connect(t, url, JSONProtocol, "", nil),
+	}
+	waitConns(t, s, 3)
+
+	delivered, err := s.BroadcastSync(context.Background(), "notice")
+	if err != nil || delivered != 3 {
+		t.Fatalf("delivered %d, %v", delivered, err)
+	}
+	for _, c := range clients {
+		c.activeConn().SetReadDeadline(time.Now().Add(time.Second))
+		if data, _, err := c.ReadFrame(); err != nil || !strings.Contains(string(data), "notice") {
+			t.Fatalf("got %q, %v", data, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if delivered, err := s.BroadcastSync(ctx, "late"); delivered != 0 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("a cancelled BroadcastSync delivered %d, %v", delivered, err)
+	}
+}
+
+func TestBroadcastSyncStopsWaitingAtDeadline(t *testing.T) {
+	s := newTestServer("")
+	reader := servePipe(t, s)
+	waitConns(t, s, 1)
+	// Nobody receives on the second pipe, so the write to it never completes.
+	servePipe(t, s)
+	waitConns(t, s, 2)
+	go reader.Receive()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	delivered, err := s.BroadcastSync(ctx, "stuck")
+	if delivered != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("delivered %d, %v", delivered, err)
+	}
+}
+
+func TestBroadcastsCarryTheSendersRole(t *testing.T) {
+	s := newTestServer("")
+	s.Passwords = map[string]string{"user": RoleUser, "admin": RoleAdmin}
+	s.UnknownTypePolicy = UnknownTypeBroadcast
+	url := startServer(t, s)
+	admin := connect(t, url, JSONProtocol, "admin", nil)
+	user := connect(t, url, JSONProtocol, "user", nil)
+	receiver := connect(t, url, JSONProtocol, "user", nil)
+	waitConns(t, s, 3)
+
+	for _, tc := range []struct {
+		sender  *ChatClient
+		message Message
+		want    string
+	}{
+		{admin, Message{Body: "from admin"}, RoleAdmin},
+		// A client can not claim a role it did not authenticate with.
+		{user, Message{Body: "from user", FromRole: RoleAdmin}, RoleUser},
+		{user, Message{Type: "shout", Body: "custom", FromRole: RoleAdmin}, RoleUser},
+	} {
+		tc.sender.SendJSON(tc.message)
+		if message, err := receiver.ReadJSON(); err != nil || message.Body != tc.message.Body || message.FromRole != tc.want {
+			t.Fatalf("got %+v, %v, want from_role %q", message, err, tc.want)
+		}
+	}
+	s.Broadcast("from server")
+	if message, err := receiver.ReadJSON(); err != nil || message.FromRole != "" {
+		t.Fatalf("server broadcast got %+v, %v", message, err)
+	}
+}
+
+func TestStopAndWaitHoldsMessagesUntilAcked(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	c := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.StopAndWait = true })
+	waitConns(t, s, 1)
+
+	// Broadcasts do not wait for the ack, the connection holds the second message.
+	s.Broadcast("one")
+	s.Broadcast("two")
+	first, err := c.ReadJSON()
+	if err != nil || first.Body != "one" {
+		t.Fatalf("got %+v, %v", first, err)
+	}
+	conn := s.serverConnPool.snapshot()[0]
+	time.Sleep(50 * time.Millisecond)
+	conn.sendMu.Lock()
+	delivered := conn.delivered
+	conn.sendMu.Unlock()
+	if delivered != 1 {
+		t.Fatalf("%d messages went out before the first was acked", delivered)
+	}
+	if err := c.Ack(first); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := c.ReadJSON(); err != nil || message.Body != "two" || message.DeliverySeq != first.DeliverySeq+1 {
+		t.Fatalf("got %+v, %v after the ack", message, err)
+	}
+}
+
+func TestStopAndWaitDropsConnectionsThatDoNotAck(t *testing.T) {
+	s := newTestServer("")
+	clock := newFakeClock()
+	s.Clock = clock
+	s.AckTimeout = time.Minute
+	url := startServer(t, s)
+	c := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.StopAndWait = true })
+	waitConns(t, s, 1)
+
+	s.Broadcast("one")
+	c.ReadJSON()
+	if err := s.Broadcast("two"); err != nil {
+		t.Fatal(err)
+	}
+	// The throughput sampler and the writer waiting for the ack are waiting on the clock.
+	waitUntil(t, func() bool { return clock.Waiting() == 2 })
+	clock.Advance(time.Minute)
+	waitConns(t, s, 0)
+	if _, err := c.ReadJSON(); err == nil {
+		t.Fatal("the connection that did not ack is still open")
+	}
+}
+
+func TestStopAndWaitDoesNotHoldUpOtherClients(t *testing.T) {
+	s := newTestServer("")
+	s.AckTimeout = 2 * time.Second
+	url := startServer(t, s)
+	slow := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.StopAndWait = true })
+	waitConns(t, s, 1)
+	sender := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 2)
+	receiver := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 3)
+	// Reads the next message of c, failing unless it is body and arrives well before the AckTimeout.
+	readSoon := func(c *ChatClient, body string) Message {
+		t.Helper()
+		c.activeConn().SetReadDeadline(time.Now().Add(time.Second))
+		defer c.activeConn().SetReadDeadline(time.Time{})
+		message, err := c.ReadJSON()
+		if err != nil || message.Body != body {
+			t.Fatalf("got %+v, %v, want %q", message, err, body)
+		}
+		return message
+	}
+
+	sender.SendJSON(Message{Body: "one"})
+	readSoon(receiver, "one")
+	first := readSoon(slow, "one")
+	// While "one" is unacked, messages from both senders still reach everyone else at once.
+	sender.SendJSON(Message{Body: "two"})
+	readSoon(receiver, "two")
+	slow.SendJSON(Message{Body: "from the slow client"})
+	readSoon(receiver, "from the slow client")
+	readSoon(sender, "from the slow client")
+
+	time.Sleep(50 * time.Millisecond)
+	if err := slow.Ack(first); err != nil {
+		t.Fatal(err)
+	}
+	readSoon(slow, "two")
+	if n := len(s.serverConnPool.snapshot()); n != 3 {
+		t.Fatalf("%d connections, the client that acked was dropped", n)
+	}
+}
+
+func TestPerRecipientTransform(t *testing.T) {
+	s := newTestServer("")
+	s.PerRecipientTransform = func(recipient ConnectionInfo, message Message) Message {
+		if recipient.ClientID != "" && strings.Contains(message.Body, "@"+recipient.ClientID) {
+			message.Body = "[to you] " + message.Body
+		}
+		return message
+	}
+	url := startServer(t, s)
+	withID := func(id string) func(*ChatClient) { return func(c *ChatClient) { c.ClientID = id } }
+	sender := connect(t, url, JSONProtocol, "", withID("alice"))
+	bob := connect(t, url, JSONProtocol, "", withID("bob"))
+	carol := connect(t, url, JSONProtocol, "", withID("carol"))
+	waitConns(t, s, 3)
+
+	sender.SendJSON(Message{Body: "hi @bob"})
+	if message, err := bob.ReadJSON(); err != nil || message.Body != "[to you] hi @bob" {
+		t.Fatalf("the mentioned client got %+v, %v", message, err)
+	}
+	if message, err := carol.ReadJSON(); err != nil || message.Body != "hi @bob" {
+		t.Fatalf("another client got %+v, %v", message, err)
+	}
+}
+
+func TestLastActivity(t *testing.T) {
+	s := newTestServer("")
+	clock := newFakeClock()
+	s.Clock = clock
+	ids := make(chan string, 2)
+	s.OnConnect = func(ctx *ConnContext) { ids <- ctx.ID }
+	active := servePipe(t, s)
+	activeID := <-ids
+	idle := servePipe(t, s)
+	idleID := <-ids
+	waitConns(t, s, 2)
+	joined := clock.Now()
+	lastActivity := func(id string) (at time.Time) {
+		s.ForEachConnection(func(info ConnectionInfo) bool {
+			if info.ID == id {
+				at = info.LastActivity
+			}
+			return true
+		})
+		return at
+	}
+	if !lastActivity(activeID).Equal(joined) || !lastActivity(idleID).Equal(joined) {
+		t.Fatalf("last activity %v and %v, want the join time %v", lastActivity(activeID), lastActivity(idleID), joined)
+	}
+
+	clock.Advance(time.Minute)
+	active.Send(Message{Type: MessageTypeHeartbeat})
+	waitUntil(t, func() bool { return lastActivity(activeID).Equal(clock.Now()) })
+	if !lastActivity(idleID).Equal(joined) {
+		t.Fatalf("the idle connection's last activity moved to %v", lastActivity(idleID))
+	}
+
+	// A message written to a connection counts as activity too.
+	clock.Advance(time.Minute)
+	go s.Push(idleID, Message{Type: MessageTypeSystem, Body: "ping"})
+	receive(t, idle)
+	waitUntil(t, func() bool { return lastActivity(idleID).Equal(clock.Now()) })
+}
+
+// A slowTransport takes a while to Send and records how many of its kind are sending at once.
+type slowTransport struct {
+	*failingTransport
+	active, peak, sent *atomic.Int32
+}
+
+func (s slowTransport) Send(Message) error {
+	n := s.active.Add(1)
+	for peak := s.peak.Load(); n > peak && !s.peak.CompareAndSwap(peak, n); peak = s.peak.Load() {
+	}
+	time.Sleep(5 * time.Millisecond)
+	s.active.Add(-1)
+	s.sent.Add(1)
+	return nil
+}
+
+func TestBroadcastWorkersAreCapped(t *testing.T) {
+	s := newTestServer("")
+	s.BroadcastWorkers = 4
+	var active, peak, sent atomic.Int32
+	const connections = 40
+	for i := 0; i < connections; i++ {
+		tr := slowTransport{newFailingTransport(), &active, &peak, &sent}
+		go s.ServeTransport(tr)
+		t.Cleanup(func() { tr.Close() })
+	}
+	waitConns(t, s, connections)
+
+	if err := s.Broadcast("to everyone"); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Load() != connections {
+		t.Fatalf("sent to %d connections, want %d", sent.Load(), connections)
+	}
+	if p := peak.Load(); p > 4 || p < 2 {
+		t.Fatalf("%d writes ran at once, want between 2 and the cap of 4", p)
+	}
+}
+
+// Returns the ClientID of each registered connection.
+func clientIDs(s *ChatServer) []string {
+	var ids []string
+	s.ForEachConnection(func(info ConnectionInfo) bool {
+		ids = append(ids, info.ClientID)
+		return true
+	})
+	return ids
+}
+
+func TestClaimID(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	guest := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.ClientID = "guest" })
+	waitConns(t, s, 1)
+	bob := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.ClientID = "bob" })
+	waitConns(t, s, 2)
+
+	guest.SendJSON(Message{Type: MessageTypeClaimID, ID: "alice"})
+	for _, c := range []*ChatClient{guest, bob} {
+		if message, err := c.ReadJSON(); err != nil || message.Type != MessageTypeSystem || message.Body != "guest is now known as alice." {
+			t.Fatalf("got %+v, %v, want the rename notice", message, err)
+		}
+	}
+	if ids := clientIDs(s); len(ids) != 2 || ids[0] != "alice" || ids[1] != "bob" {
+		t.Fatalf("ClientIDs %q after the claim", ids)
+	}
+}
+
+func TestClaimIDRejectsCollisions(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	guest := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.ClientID = "guest" })
+	waitConns(t, s, 1)
+	bob := connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.ClientID = "bob" })
+	waitConns(t, s, 2)
+
+	guest.SendJSON(Message{Type: MessageTypeClaimID, ID: "bob"})
+	if message, err := guest.ReadJSON(); err != nil || message.Type != MessageTypeError || message.Reason != ReasonClientIDTaken {
+		t.Fatalf("got %+v, %v, want a client_id_taken error", message, err)
+	}
+	if ids := clientIDs(s); len(ids) != 2 || ids[0] != "guest" || ids[1] != "bob" {
+		t.Fatalf("ClientIDs %q after a rejected claim", ids)
+	}
+	// No rename notice went out, the next message bob gets is the one after.
+	s.Broadcast("next")
+	if message, err := bob.ReadJSON(); err != nil || message.Body != "next" {
+		t.Fatalf("got %+v, %v", message, err)
+	}
+}
+
+func TestTextNoticeFormat(t *testing.T) {
+	s := newTestServer("")
+	s.DuplicateLimit = 1
+	s.TextNoticeFormat = TextNoticePrefixed
+	url := startServer(t, s)
+	text := connect(t, url, "", "", nil)
+	structured := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 2)
+
+	text.Send("again")
+	text.Send("again")
+	if message, err := structured.ReadJSON(); err != nil || message.Body != "again" {
+		t.Fatalf("got %+v, %v", message, err)
+	}
+	if message, err := text.Read(); err != nil || message != "[error:duplicate] Stop sending the same message." {
+		t.Fatalf("text client got %q, %v", message, err)
+	}
+
+	structured.SendJSON(Message{Body: "again"})
+	structured.SendJSON(Message{Body: "again"})
+	if message, err := text.Read(); err != nil || message != "again" {
+		t.Fatalf("chat messages are not prefixed, got %q, %v", message, err)
+	}
+	if message, err := structured.ReadJSON(); err != nil || message.Type != MessageTypeError || message.Reason != ReasonDuplicate || message.Body != "Stop sending the same message." {
+		t.Fatalf("JSON client got %+v, %v", message, err)
+	}
+}
+
+// Returns the server-assigned ID of each registered connection.
+func connIDs(s *ChatServer) []string {
+	var ids []string
+	s.ForEachConnection(func(info ConnectionInfo) bool {
+		ids = append(ids, info.ID)
+		return true
+	})
+	return ids
+}
+
+func TestSetMaxConnectionsEvictsTheNewest(t *testing.T) {
+	s := newTestServer("")
+	var clients []Transport
+	for i := 1; i <= 4; i++ {
+		clients = append(clients, servePipe(t, s))
+		waitConns(t, s, i)
+	}
+
+	if evicted := s.SetMaxConnections(10); evicted != 0 {
+		t.Fatalf("raising the limit evicted %d connections", evicted)
+	}
+	done := make(chan int, 1)
+	go func() { done <- s.SetMaxConnections(2) }()
+	for _, c := range clients[2:] {
+		if message := receive(t, c); message.Type != MessageTypeMaintenance || message.Reason != ReasonEvicted {
+			t.Fatalf("got %+v, want an eviction notice", message)
+		}
+	}
+	if evicted := <-done; evicted != 2 {
+		t.Fatalf("evicted %d connections, want 2", evicted)
+	}
+	waitConns(t, s, 2)
+	if ids := connIDs(s); ids[0] != "1" || ids[1] != "2" {
+		t.Fatalf("connections %q are left, want the first two", ids)
+	}
+
+	// New connections are refused until there is room.
+	if message := receive(t, servePipe(t, s)); message.Type != MessageTypeError || message.Reason != ReasonServerFull {
+		t.Fatalf("got %+v, want a server_full error", message)
+	}
+	if n := len(s.serverConnPool.snapshot()); n != 2 {
+		t.Fatalf("%d connections over a limit of 2", n)
+	}
+}
+
+func TestSetMaxConnectionsEvictsTheIdlest(t *testing.T) {
+	s := newTestServer("")
+	clock := newFakeClock()
+	s.Clock = clock
+	s.EvictionPolicy = EvictIdlest
+	var clients []Transport
+	for i := 1; i <= 3; i++ {
+		clients = append(clients, servePipe(t, s))
+		waitConns(t, s, i)
+		clock.Advance(time.Second)
+	}
+	// The first connection is the oldest but not the idlest once it sends something.
+	clients[0].Send(Message{Type: MessageTypeHeartbeat})
+	waitUntil(t, func() bool { return s.serverConnPool.snapshot()[0].lastActivity.Load() == clock.Now().UnixNano() })
+
+	go s.SetMaxConnections(2)
+	if message := receive(t, clients[1]); message.Reason != ReasonEvicted {
+		t.Fatalf("got %+v, want the idlest connection evicted", message)
+	}
+	waitConns(t, s, 2)
+	if ids := connIDs(s); ids[0] != "1" || ids[1] != "3" {
+		t.Fatalf("connections %q are left, want 1 and 3", ids)
+	}
+}
+
+func TestRecipientsSeeTheSameOrder(t *testing.T) {
+	const senders, perSender = 3, 20
+	s := newTestServer("")
+	s.BroadcastWorkers = 4
+	url := startServer(t, s)
+	var recipients []*ChatClient
+	for i := 0; i < 3; i++ {
+		recipients = append(recipients, connect(t, url, JSONProtocol, "", func(c *ChatClient) { c.Listener = true }))
+	}
+	var clients []*ChatClient
+	for i := 0; i < senders; i++ {
+		clients = append(clients, connect(t, url, JSONProtocol, "", nil))
+	}
+	waitConns(t, s, len(recipients)+senders)
+
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *ChatClient) {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				c.SendJSON(Message{Body: strconv.Itoa(i) + "-" + strconv.Itoa(j)})
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	var first []Message
+	for r, c := range recipients {
+		var got []Message
+		for len(got) < senders*perSender {
+			message, err := c.ReadJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) > 0 && message.Seq <= got[len(got)-1].Seq {
+				t.Fatalf("recipient %d got seq %d after %d", r, message.Seq, got[len(got)-1].Seq)
+			}
+			got = append(got, message)
+		}
+		if first == nil {
+			first = got
+			continue
+		}
+		for i := range got {
+			if got[i].Seq != first[i].Seq || got[i].Body != first[i].Body {
+				t.Fatalf("recipient %d got %+v at %d, recipient 0 got %+v", r, got[i], i, first[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package chatroom
+
+import "errors"
+
+// ServerState is the logical state of a chat server that outlives its connections, so a new ChatServer
+// with different settings can take over from it, for example on a configuration reload.
+// Connections are not part of it, clients register again with the new server.
+type ServerState struct {
+	// LastSeq is the Seq of the last broadcast, the new server continues from it so clients
+	// ordering messages by Seq do not see it start over.
+	LastSeq uint64 `json:"last_seq"`
+	// LastConnID is the last connection ID assigned, so connection IDs are not reused.
+	LastConnID uint64 `json:"last_conn_id"`
+	// Paused is whether the chat room is paused, see Pause. Messages queued by PauseQueue are not carried over.
+	Paused bool `json:"paused"`
+}
+
+// Returns the server's current ServerState. It is meant to be called once the server stopped taking
+// messages, a broadcast after it is not reflected in LastSeq.
+func (s *ChatServer) ExportState() ServerState {
+	return ServerState{
+		LastSeq:    s.lastSeq.Load(),
+		LastConnID: s.lastConnID.Load(),
+		Paused:     s.Paused(),
+	}
+}
+
+// Restores a ServerState exported from another server. It must be called before Run.
+func (s *ChatServer) ImportState(state ServerState) error {
+	s.mu.Lock()
+	running := s.httpServer != nil
+	s.mu.Unlock()
+	if running || s.lastSeq.Load() != 0 || s.lastConnID.Load() != 0 {
+		return errors.New("state can only be imported into a server that has not run")
+	}
+	s.lastSeq.Store(state.LastSeq)
+	s.lastConnID.Store(state.LastConnID)
+	s.pauseMu.Lock()
+	s.paused = state.Paused
+	s.pauseMu.Unlock()
+	return nil
+}
@@ -0,0 +1,50 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	old := newTestServer("")
+	client := servePipe(t, old)
+	waitConns(t, old, 1)
+	for _, body := range []string{"one", "two"} {
+		go old.Broadcast(body)
+		receive(t, client)
+	}
+	old.Pause()
+
+	data, err := json.Marshal(old.ExportState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state ServerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer("")
+	if err := s.ImportState(state); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.ExportState(); got != old.ExportState() {
+		t.Fatalf("imported state %+v, exported %+v", got, old.ExportState())
+	}
+	if !s.Paused() {
+		t.Fatal("the new server is not paused")
+	}
+
+	// The new server picks up where the old one left off.
+	client = servePipe(t, s)
+	waitConns(t, s, 1)
+	if id := s.serverConnPool.snapshot()[0].ctx.ID; id != "2" {
+		t.Fatalf("connection ID %s, want 2", id)
+	}
+	go s.Broadcast("three")
+	if message := receive(t, client); message.Seq != 3 {
+		t.Fatalf("got %+v, want seq 3", message)
+	}
+	if err := s.ImportState(state); err == nil {
+		t.Fatal("state was imported into a server in use")
+	}
+}
@@ -0,0 +1,213 @@
+package chatroom
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The default window Throughput is computed over.
+const defaultThroughputWindow = 10 * time.Second
+
+// ThroughputStats is the rate of messages and message bytes received from and sent to clients.
+type ThroughputStats struct {
+	// Window is the period the rates are averaged over.
+	Window            time.Duration
+	MessagesInPerSec  float64
+	BytesInPerSec     float64
+	MessagesOutPerSec float64
+	BytesOutPerSec    float64
+}
+
+// A throughput counts messages on the hot path with atomics, a ticker samples the counters
+// so rates can be computed over a rolling window without locking per message.
+type throughput struct {
+	messagesIn  atomic.Uint64
+	bytesIn     atomic.Uint64
+	messagesOut atomic.Uint64
+	bytesOut    atomic.Uint64
+
+	// mu guards window, clock and samples, which are ordered from oldest to newest and span at most window.
+	mu      sync.Mutex
+	window  time.Duration
+	clock   Clock
+	samples []throughputSample
+}
+
+// A throughputSample is a copy of the counters at a point in time.
+type throughputSample struct {
+	at                                         time.Time
+	messagesIn, bytesIn, messagesOut, bytesOut uint64
+}
+
+// Counts a message received from a client.
+func (tp *throughput) addIn(bytes int) {
+	tp.messagesIn.Add(1)
+	tp.bytesIn.Add(uint64(bytes))
+}
+
+// Counts a message sent to a client.
+func (tp *throughput) addOut(bytes int) {
+	tp.bytesOut.Add(uint64(bytes))
+	tp.messagesOut.Add(1)
+}
+
+// Returns the current counters.
+func (tp *throughput) sample(now time.Time) throughputSample {
+	return throughputSample{
+		at:          now,
+		messagesIn:  tp.messagesIn.Load(),
+		bytesIn:     tp.bytesIn.Load(),
+		messagesOut: tp.messagesOut.Load(),
+		bytesOut:    tp.bytesOut.Load(),
+	}
+}
+
+// Starts sampling the counters ten times per window with the clock until quit is closed.
+func (tp *throughput) start(window time.Duration, clock Clock, quit <-chan struct{}) {
+	tp.mu.Lock()
+	tp.window = window
+	tp.clock = clock
+	tp.mu.Unlock()
+	interval := window / 10
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	go tp.run(interval, clock, quit)
+}
+
+// A blocking function that samples the counters every interval until quit is closed.
+func (tp *throughput) run(interval time.Duration, clock Clock, quit <-chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-clock.After(interval):
+			tp.mu.Lock()
+			tp.samples = append(tp.samples, tp.sample(now))
+			// Keep the newest sample that is at least a window old, so the rates span the whole window.
+			for len(tp.samples) > 1 && now.Sub(tp.samples[1].at) >= tp.window {
+				tp.samples = tp.samples[1:]
+			}
+			tp.mu.Unlock()
+		}
+	}
+}
+
+// Returns the rates between the oldest sample in the window and now.
+func (tp *throughput) stats() ThroughputStats {
+	tp.mu.Lock()
+	stats := ThroughputStats{Window: tp.window}
+	if len(tp.samples) == 0 {
+		tp.mu.Unlock()
+		return stats
+	}
+	oldest := tp.samples[0]
+	now := tp.clock.Now()
+	tp.mu.Unlock()
+	current := tp.sample(now)
+	seconds := now.Sub(oldest.at).Seconds()
+	if seconds <= 0 {
+		return stats
+	}
+	stats.MessagesInPerSec = float64(current.messagesIn-oldest.messagesIn) / seconds
+	stats.BytesInPerSec = float64(current.bytesIn-oldest.bytesIn) / seconds
+	stats.MessagesOutPerSec = float64(current.messagesOut-oldest.messagesOut) / seconds
+	stats.BytesOutPerSec = float64(current.bytesOut-oldest.bytesOut) / seconds
+	return stats
+}
+
+// Returns the message and byte rates of the chat server over ThroughputWindow.
+// Rates are zero until the first sample is taken, a tenth of the window after the server starts.
+func (s *ChatServer) Throughput() ThroughputStats {
+	return s.throughput.stats()
+}
+
+// BacklogStats describes the register events waiting for the ConnPool.
+type BacklogStats struct {
+	// Pending is the number of register events waiting, Capacity is RegisterBacklog.
+	Pending  int
+	Capacity int
+	// Rejected is the number of connections turned away because the backlog was full.
+	Rejected uint64
+}
+
+// Returns the depth of the register backlog and how many connections it has turned away.
+func (s *ChatServer) Backlog() BacklogStats {
+	pool := s.serverConnPool
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return BacklogStats{Pending: len(pool.register), Capacity: cap(pool.register), Rejected: pool.rejected.Load()}
+}
+
+// The JSON document served on StatsPath.
+type statsDocument struct {
+	StartedAt     time.Time       `json:"started_at"`
+	UptimeSeconds float64         `json:"uptime_seconds"`
+	Connections   int             `json:"connections"`
+	Throughput    throughputStats `json:"throughput"`
+	Backlog       backlogStats    `json:"backlog"`
+	Throttle      throttleStats   `json:"throttle"`
+}
+
+// The JSON form of ThrottleStats.
+type throttleStats struct {
+	Delayed uint64 `json:"delayed"`
+	Shed    uint64 `json:"shed"`
+}
+
+// The JSON form of BacklogStats.
+type backlogStats struct {
+	Pending  int    `json:"pending"`
+	Capacity int    `json:"capacity"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// The JSON form of ThroughputStats.
+type throughputStats struct {
+	WindowSeconds     float64 `json:"window_seconds"`
+	MessagesInPerSec  float64 `json:"messages_in_per_sec"`
+	BytesInPerSec     float64 `json:"bytes_in_per_sec"`
+	MessagesOutPerSec float64 `json:"messages_out_per_sec"`
+	BytesOutPerSec    float64 `json:"bytes_out_per_sec"`
+}
+
+// Serves the server stats as JSON. If StatsToken is set, the request must carry it as a bearer token.
+// It only reads counters and the pool size, so it is cheap enough to be polled frequently.
+func (s *ChatServer) serveStats(w http.ResponseWriter, r *http.Request) {
+	if s.StatsToken != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.StatsToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	tp := s.Throughput()
+	backlog := s.Backlog()
+	throttled := s.Throttled()
+	s.serverConnPool.mu.Lock()
+	connections := len(s.serverConnPool.connections)
+	s.serverConnPool.mu.Unlock()
+	document := statsDocument{
+		StartedAt:     s.StartedAt(),
+		UptimeSeconds: s.Uptime().Seconds(),
+		Connections:   connections,
+		Throughput: throughputStats{
+			WindowSeconds:     tp.Window.Seconds(),
+			MessagesInPerSec:  tp.MessagesInPerSec,
+			BytesInPerSec:     tp.BytesInPerSec,
+			MessagesOutPerSec: tp.MessagesOutPerSec,
+			BytesOutPerSec:    tp.BytesOutPerSec,
+		},
+		Backlog:  backlogStats{Pending: backlog.Pending, Capacity: backlog.Capacity, Rejected: backlog.Rejected},
+		Throttle: throttleStats{Delayed: throttled.Delayed, Shed: throttled.Shed},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(document); err != nil {
+		s.logger.Println("Can not write stats:", err)
+	}
+}
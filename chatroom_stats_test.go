@@ -0,0 +1,210 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Advances the clock by one sampling interval and waits until the sampler has taken the sample.
+func tick(t *testing.T, tp *throughput, clock *fakeClock, interval time.Duration) {
+	t.Helper()
+	waitUntil(t, func() bool { return clock.Waiting() == 1 })
+	clock.Advance(interval)
+	now := clock.Now()
+	waitUntil(t, func() bool {
+		tp.mu.Lock()
+		defer tp.mu.Unlock()
+		return len(tp.samples) > 0 && tp.samples[len(tp.samples)-1].at.Equal(now)
+	})
+}
+
+func TestThroughputOverRollingWindow(t *testing.T) {
+	var tp throughput
+	clock := newFakeClock()
+	quit := make(chan struct{})
+	defer close(quit)
+	tp.start(10*time.Second, clock, quit)
+	if stats := tp.stats(); stats.MessagesInPerSec != 0 || stats.Window != 10*time.Second {
+		t.Fatalf("got %+v before the first sample", stats)
+	}
+
+	tick(t, &tp, clock, time.Second)
+	for i := 0; i < 5; i++ {
+		tp.addIn(100)
+	}
+	tp.addOut(10)
+	tp.addOut(10)
+	tick(t, &tp, clock, time.Second)
+	stats := tp.stats()
+	if stats.MessagesInPerSec != 5 || stats.BytesInPerSec != 500 || stats.MessagesOutPerSec != 2 || stats.BytesOutPerSec != 20 {
+		t.Fatalf("got %+v", stats)
+	}
+
+	// Once the traffic is older than the window, the rates drop back to zero.
+	for i := 0; i < 11; i++ {
+		tick(t, &tp, clock, time.Second)
+	}
+	if stats := tp.stats(); stats.MessagesInPerSec != 0 || stats.BytesOutPerSec != 0 {
+		t.Fatalf("got %+v after the window passed", stats)
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	s := newTestServer("")
+	s.StatsPath = "/stats"
+	s.StatsToken = "token"
+	url := startServer(t, s)
+	connect(t, url, "", "", nil)
+	waitConns(t, s, 1)
+	statsURL := "http://" + s.listenAddr + "/stats"
+
+	response, err := http.Get(statsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("stats without the token got %d", response.StatusCode)
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, statsURL, nil)
+	request.Header.Set("Authorization", "Bearer token")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var document statsDocument
+	if err := json.NewDecoder(response.Body).Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+	if document.Connections != 1 || document.StartedAt.IsZero() || document.Throughput.WindowSeconds != 10 {
+		t.Fatalf("got %+v", document)
+	}
+}
+
+// A stalledWriter blocks every write until its channel is closed.
+type stalledWriter chan struct{}
+
+func (w stalledWriter) Write(p []byte) (int, error) {
+	<-w
+	return len(p), nil
+}
+
+func TestRegisterBacklogIsBounded(t *testing.T) {
+	s := newTestServer("")
+	s.RegisterBacklog = 2
+	s.LogPoolChanges = true
+	// The pool logs each registration, stalling its log output on the first one
+	// makes the next ones queue up behind it.
+	stall := make(chan struct{})
+	s.serverConnPool.logger = log.New(stalledWriter(stall), "", 0)
+	servePipe(t, s)
+	waitConns(t, s, 1)
+	servePipe(t, s)
+	servePipe(t, s)
+	waitUntil(t, func() bool { return s.Backlog().Pending == 2 })
+
+	if message := receive(t, servePipe(t, s)); message.Type != MessageTypeError || message.Reason != ReasonBusy {
+		t.Fatalf("got %+v, want a busy error", message)
+	}
+	if backlog := s.Backlog(); backlog != (BacklogStats{Pending: 2, Capacity: 2, Rejected: 1}) {
+		t.Fatalf("got %+v", backlog)
+	}
+	close(stall)
+	waitConns(t, s, 3)
+	if backlog := s.Backlog(); backlog.Pending != 0 {
+		t.Fatalf("got %+v once the pool caught up", backlog)
+	}
+}
+
+func TestConnectionsClosedInTheBacklogAreNotRegistered(t *testing.T) {
+	// Which of the two events the pool takes first is up to chance, try a few times.
+	for i := 0; i < 20; i++ {
+		s := newTestServer("")
+		s.RegisterBacklog = 2
+		s.LogPoolChanges = true
+		stall := make(chan struct{})
+		s.serverConnPool.logger = log.New(stalledWriter(stall), "", 0)
+		servePipe(t, s)
+		waitConns(t, s, 1)
+		// The client is gone before it is served, so its reader fails at once and tries to unregister it
+		// while the registration is still queued. The loop then takes the two events in either order.
+		client, server := NewPipe()
+		client.Close()
+		done := make(chan struct{})
+		go func() {
+			s.ServeTransport(server)
+			close(done)
+		}()
+		waitUntil(t, func() bool { return s.Backlog().Pending == 1 })
+		time.Sleep(10 * time.Millisecond)
+		close(stall)
+		<-done
+		// The pool takes events in order, once a later registration shows up both events have been handled.
+		next, nextServer := NewPipe()
+		t.Cleanup(func() { next.Close() })
+		go s.ServeTransport(nextServer)
+		inPool := func(t Transport) bool {
+			for _, conn := range s.serverConnPool.snapshot() {
+				if conn.t == t {
+					return true
+				}
+			}
+			return false
+		}
+		waitUntil(t, func() bool { return inPool(nextServer) })
+		if inPool(server) {
+			t.Fatal("a connection that closed in the backlog was registered")
+		}
+		s.stopPool()
+	}
+}
+
+func TestStopPoolClosesConnectionsInTheBacklog(t *testing.T) {
+	s := newTestServer("")
+	s.RegisterBacklog = 2
+	s.LogPoolChanges = true
+	stall := make(chan struct{})
+	s.serverConnPool.logger = log.New(stalledWriter(stall), "", 0)
+	clients := []Transport{servePipe(t, s)}
+	waitConns(t, s, 1)
+	clients = append(clients, servePipe(t, s), servePipe(t, s))
+	waitUntil(t, func() bool { return s.Backlog().Pending == 2 })
+
+	stopped := make(chan struct{})
+	go func() {
+		s.stopPool()
+		close(stopped)
+	}()
+	waitUntil(t, func() bool {
+		select {
+		case <-s.serverConnPool.quit:
+			return true
+		default:
+			return false
+		}
+	})
+	close(stall)
+	<-stopped
+	closed := make(chan error, len(clients))
+	for _, c := range clients {
+		go func() {
+			_, err := c.Receive()
+			closed <- err
+		}()
+	}
+	for range clients {
+		select {
+		case err := <-closed:
+			if err == nil {
+				t.Fatal("got a message instead of the connection closing")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("a connection is still open after the pool stopped")
+		}
+	}
+}
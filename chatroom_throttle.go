@@ -0,0 +1,94 @@
+package chatroom
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Returned by broadcastFrom when the global throttle sheds a message.
+var errThrottled = errors.New("broadcast rate limit exceeded")
+
+// ThrottlePolicy is what happens to a message from a client when MaxBroadcastsPerSec is exceeded.
+type ThrottlePolicy int
+
+const (
+	// ThrottleDelay holds the message until the rate allows it, slowing down the sender's reader.
+	ThrottleDelay ThrottlePolicy = iota
+	// ThrottleShed drops the message and answers the sender with a throttled error.
+	ThrottleShed
+)
+
+// ThrottleStats counts the messages the global throttle held back.
+type ThrottleStats struct {
+	Delayed uint64
+	Shed    uint64
+}
+
+// A tokenBucket refills at rate tokens per second up to burst, one token is one broadcast.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	// started is set once the bucket was filled to burst, on first use.
+	started bool
+
+	delayed atomic.Uint64
+	shed    atomic.Uint64
+}
+
+// Takes a token at now. If none is left and reserve is set, the token is taken in advance and the time
+// to wait for it is returned, otherwise ok is false and nothing is taken.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int, reserve bool) (wait time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.started {
+		b.tokens = float64(burst)
+		b.last = now
+		b.started = true
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.tokens+elapsed.Seconds()*rate, float64(burst))
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if !reserve {
+		return 0, false
+	}
+	// Tokens taken in advance drive the count below zero, so each waiter waits for its own token.
+	wait = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	b.tokens--
+	return wait, true
+}
+
+// Applies MaxBroadcastsPerSec to a message from sender, waiting for the rate to allow it under ThrottleDelay.
+// Returns false if the message was shed, in which case the sender has been told.
+func (s *ChatServer) throttle(sender *connection) bool {
+	if s.MaxBroadcastsPerSec <= 0 {
+		return true
+	}
+	burst := s.BroadcastBurst
+	if burst <= 0 {
+		burst = 1
+	}
+	wait, ok := s.broadcastBucket.take(s.clock().Now(), s.MaxBroadcastsPerSec, burst, s.ThrottlePolicy == ThrottleDelay)
+	if !ok {
+		s.broadcastBucket.shed.Add(1)
+		sender.reply(s.localize(sender.locale, Message{Type: MessageTypeError, Body: "The chat room is busy, the message was dropped.", Reason: ReasonThrottled}))
+		return false
+	}
+	if wait > 0 {
+		s.broadcastBucket.delayed.Add(1)
+		<-s.clock().After(wait)
+	}
+	return true
+}
+
+// Returns how many messages from clients MaxBroadcastsPerSec has delayed and shed.
+func (s *ChatServer) Throttled() ThrottleStats {
+	return ThrottleStats{Delayed: s.broadcastBucket.delayed.Load(), Shed: s.broadcastBucket.shed.Load()}
+}
@@ -0,0 +1,91 @@
+package chatroom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottleShedsAboveTheGlobalRate(t *testing.T) {
+	s := newTestServer("")
+	clock := newFakeClock()
+	s.Clock = clock
+	s.MaxBroadcastsPerSec = 10
+	s.BroadcastBurst = 2
+	s.ThrottlePolicy = ThrottleShed
+	senders := []Transport{servePipe(t, s)}
+	waitConns(t, s, 1)
+	senders = append(senders, servePipe(t, s))
+	waitConns(t, s, 2)
+	receiver := servePipe(t, s)
+	waitConns(t, s, 3)
+
+	// The burst is shared by every client, the third message within it is shed whoever sends it.
+	senders[0].Send(Message{Body: "ok"})
+	receive(t, senders[1])
+	receive(t, receiver)
+	senders[1].Send(Message{Body: "ok"})
+	receive(t, senders[0])
+	receive(t, receiver)
+	senders[0].Send(Message{Body: "shed"})
+	if message := receive(t, senders[0]); message.Type != MessageTypeError || message.Reason != ReasonThrottled {
+		t.Fatalf("got %+v, want a throttled error", message)
+	}
+	if stats := s.Throttled(); stats != (ThrottleStats{Shed: 1}) {
+		t.Fatalf("got %+v", stats)
+	}
+
+	// A tenth of a second later there is room for one more.
+	clock.Advance(100 * time.Millisecond)
+	go senders[1].Send(Message{Body: "refilled"})
+	receive(t, senders[0])
+	if message := receive(t, receiver); message.Body != "refilled" {
+		t.Fatalf("got %+v", message)
+	}
+}
+
+func TestThrottleDelaysAboveTheGlobalRate(t *testing.T) {
+	s := newTestServer("")
+	clock := newFakeClock()
+	s.Clock = clock
+	s.MaxBroadcastsPerSec = 10
+	sender := servePipe(t, s)
+	waitConns(t, s, 1)
+	receiver := servePipe(t, s)
+	waitConns(t, s, 2)
+
+	sender.Send(Message{Body: "first"})
+	receive(t, receiver)
+	sender.Send(Message{Body: "second"})
+	// The throughput sampler and the delayed message are waiting on the clock.
+	waitUntil(t, func() bool { return clock.Waiting() == 2 })
+	if stats := s.Throttled(); stats != (ThrottleStats{Delayed: 1}) {
+		t.Fatalf("got %+v", stats)
+	}
+	clock.Advance(50 * time.Millisecond)
+	if clock.Waiting() != 2 {
+		t.Fatal("the message went out before the rate allowed it")
+	}
+	clock.Advance(50 * time.Millisecond)
+	if message := receive(t, receiver); message.Body != "second" {
+		t.Fatalf("got %+v", message)
+	}
+}
+
+func TestServerBroadcastsAreNotThrottled(t *testing.T) {
+	s := newTestServer("")
+	s.Clock = newFakeClock()
+	s.MaxBroadcastsPerSec = 1
+	s.ThrottlePolicy = ThrottleShed
+	receiver := servePipe(t, s)
+	waitConns(t, s, 1)
+
+	for _, body := range []string{"one", "two", "three"} {
+		go s.Broadcast(body)
+		if message := receive(t, receiver); message.Body != body {
+			t.Fatalf("got %+v, want %q", message, body)
+		}
+	}
+	if stats := s.Throttled(); stats != (ThrottleStats{}) {
+		t.Fatalf("got %+v", stats)
+	}
+}
@@ -0,0 +1,99 @@
+package chatroom
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// Issues a certificate for template signed by parent, a nil parent makes it self-signed.
+func issueCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca, caCert := issueCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	caKey := ca.PrivateKey.(*ecdsa.PrivateKey)
+	serverCert, _ := issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	clientCert, _ := issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	s := newTestServer("secret")
+	s.ClientCertAuth = true
+	s.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		// The handshake lets clients without a certificate in, so the chat server is the one rejecting them.
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+	}
+	url := startServer(t, s)
+
+	alice := connect(t, url, "", "", func(c *ChatClient) {
+		c.chatServer.SetTLSConfig(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}})
+	})
+	waitConns(t, s, 1)
+	var clientID string
+	s.ForEachConnection(func(info ConnectionInfo) bool {
+		clientID = info.ClientID
+		return false
+	})
+	if clientID != "alice" {
+		t.Fatalf("ClientID %q, want the certificate's common name", clientID)
+	}
+	if err := s.Broadcast("hi"); err != nil {
+		t.Fatal(err)
+	}
+	if message, err := alice.Read(); err != nil || message != "hi" {
+		t.Fatalf("got %q, %v", message, err)
+	}
+
+	// Without a certificate even the right password is not enough.
+	anonymous := connect(t, url, "", "secret", func(c *ChatClient) {
+		c.chatServer.SetTLSConfig(&tls.Config{RootCAs: pool})
+	})
+	if _, err := anonymous.Read(); err == nil {
+		t.Fatal("a client without a certificate was served")
+	}
+	if n := len(s.serverConnPool.snapshot()); n != 1 {
+		t.Fatalf("%d connections, want only the one with a certificate", n)
+	}
+}
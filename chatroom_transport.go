@@ -0,0 +1,199 @@
+package chatroom
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// ErrBadFrame is wrapped by the error Transport.Receive returns when a frame could not be decoded,
+// or was too large, but the transport can still receive the next frame.
+var ErrBadFrame = errors.New("bad frame")
+
+// ErrTransient is wrapped by the error Transport.Send returns when nothing was written and the same send
+// can be retried shortly, such as when a socket is temporarily out of buffer space.
+var ErrTransient = errors.New("transient send error")
+
+// Reports whether a Send error is worth retrying. A timed out write may have left part of a frame
+// on the wire, so only errors known to have written nothing are transient.
+func isTransient(err error) bool {
+	return errors.Is(err, ErrTransient) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOBUFS)
+}
+
+// Transport is a message-oriented connection served by the chat server.
+// The server, its connection pool and Broadcast only depend on this interface,
+// so a Transport other than a WebSocket, such as NewPipe, can be served with ServeTransport.
+type Transport interface {
+	// Send delivers one message to the peer. An error wrapping ErrTransient means the send may be retried.
+	Send(message Message) error
+	// Receive blocks until the next message from the peer arrives.
+	// An error wrapping ErrBadFrame means only this frame was rejected.
+	Receive() (Message, error)
+	// Close closes the transport, a blocked Receive returns an error.
+	Close() error
+	// RemoteAddr describes the peer, it is used in logs.
+	RemoteAddr() string
+}
+
+// A wsTransport is a Transport over a WebSocket connection using its negotiated wire format.
+type wsTransport struct {
+	ws *websocket.Conn
+	// protocol is the negotiated wire format, TextProtocol or JSONProtocol.
+	protocol string
+	// writeTimeout is applied as the write deadline of every Send, zero means no deadline.
+	writeTimeout time.Duration
+	// codec encodes messages of JSONProtocol connections.
+	codec websocket.Codec
+	// noticeFormat is how error and notice messages are written to TextProtocol connections.
+	noticeFormat TextNoticeFormat
+}
+
+// wsTransport constructor, the wire format is taken from the subprotocol chosen in the handshake.
+// A nil codec means JSONCodec.
+func newWSTransport(ws *websocket.Conn, writeTimeout time.Duration, codec Codec, noticeFormat TextNoticeFormat) *wsTransport {
+	t := &wsTransport{ws: ws, protocol: TextProtocol, writeTimeout: writeTimeout, codec: wsCodec(codec), noticeFormat: noticeFormat}
+	if protocol := ws.Config().Protocol; len(protocol) == 1 && protocol[0] == JSONProtocol {
+		t.protocol = JSONProtocol
+	}
+	return t
+}
+
+// Sends the message in the negotiated format, text connections only receive the body,
+// with error and notice messages formatted according to the notice format.
+// The write fails if it does not complete within the write timeout.
+func (t *wsTransport) Send(message Message) error {
+	if t.writeTimeout > 0 {
+		// Deadlines are enforced by the OS, so they use the real clock rather than ChatServer.Clock.
+		if err := t.ws.SetWriteDeadline(time.Now().Add(t.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	if t.protocol == JSONProtocol {
+		return t.codec.Send(t.ws, message)
+	}
+	if message.Binary {
+		return websocket.Message.Send(t.ws, []byte(message.Body))
+	}
+	return websocket.Message.Send(t.ws, t.textBody(message))
+}
+
+// Returns what a text connection receives for the message.
+func (t *wsTransport) textBody(message Message) string {
+	if t.noticeFormat != TextNoticePrefixed {
+		return message.Body
+	}
+	switch message.Type {
+	case MessageTypeError, MessageTypeSystem, MessageTypeMaintenance:
+	default:
+		return message.Body
+	}
+	prefix := message.Type
+	if message.Reason != "" {
+		prefix += ":" + message.Reason
+	}
+	return "[" + prefix + "] " + message.Body
+}
+
+// Receives the next message in the negotiated format.
+// Raw strings from text connections are wrapped into a chat Message, marked Binary if they came in a binary frame.
+// Their heartbeat string is turned into a heartbeat Message, so it is never taken for chat.
+// Frames that are too large or can not be decoded are reported with ErrBadFrame.
+func (t *wsTransport) Receive() (message Message, err error) {
+	if t.protocol == JSONProtocol {
+		err = t.codec.Receive(t.ws, &message)
+	} else {
+		message.Type = MessageTypeChat
+		err = rawFrame.Receive(t.ws, &message)
+		if err == nil && !message.Binary && message.Body == textHeartbeat {
+			message = Message{Type: MessageTypeHeartbeat}
+		}
+	}
+	if err == websocket.ErrFrameTooLarge {
+		err = fmt.Errorf("%w: %v", ErrBadFrame, err)
+	}
+	return message, err
+}
+
+// rawFrame receives a frame of a text connection into a chat Message as is, keeping its opcode.
+var rawFrame = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		message := v.(*Message)
+		message.Body = string(data)
+		message.Binary = payloadType == websocket.BinaryFrame
+		return nil
+	},
+}
+
+// Closes the WebSocket connection.
+func (t *wsTransport) Close() error {
+	return t.ws.Close()
+}
+
+// Returns the remote address of the HTTP request that opened the WebSocket connection.
+func (t *wsTransport) RemoteAddr() string {
+	return t.ws.Request().RemoteAddr
+}
+
+// A pipeTransport is one end of an in-memory Transport pair created by NewPipe.
+type pipeTransport struct {
+	addr string
+	in   <-chan Message
+	out  chan<- Message
+	// done is shared by both ends and closed by the first Close.
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+// Creates a connected pair of in-memory Transports, useful to serve a connection without a network.
+// Like net.Pipe, Send blocks until the other end receives the message.
+// Closing either end closes both.
+func NewPipe() (Transport, Transport) {
+	aToB := make(chan Message)
+	bToA := make(chan Message)
+	done := make(chan struct{})
+	closeOnce := new(sync.Once)
+	a := &pipeTransport{addr: "pipe-a", in: bToA, out: aToB, done: done, closeOnce: closeOnce}
+	b := &pipeTransport{addr: "pipe-b", in: aToB, out: bToA, done: done, closeOnce: closeOnce}
+	return a, b
+}
+
+// Sends the message to the other end, or returns io.ErrClosedPipe once the pipe is closed.
+func (p *pipeTransport) Send(message Message) error {
+	select {
+	case <-p.done:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case p.out <- message:
+		return nil
+	case <-p.done:
+		return io.ErrClosedPipe
+	}
+}
+
+// Receives the next message from the other end, or returns io.EOF once the pipe is closed.
+func (p *pipeTransport) Receive() (Message, error) {
+	select {
+	case message := <-p.in:
+		return message, nil
+	case <-p.done:
+		return Message{}, io.EOF
+	}
+}
+
+// Closes both ends of the pipe.
+func (p *pipeTransport) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return nil
+}
+
+// Returns a fixed name for this end of the pipe.
+func (p *pipeTransport) RemoteAddr() string {
+	return p.addr
+}
@@ -0,0 +1,154 @@
+package chatroom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPipeDeliversAndCloses(t *testing.T) {
+	a, b := NewPipe()
+	go a.Send(Message{Type: MessageTypeChat, Body: "ping"})
+	if message := receive(t, b); message.Body != "ping" {
+		t.Fatalf("got %+v", message)
+	}
+	b.Close()
+	if err := a.Send(Message{Body: "late"}); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("Send on a closed pipe returned %v", err)
+	}
+	if _, err := a.Receive(); !errors.Is(err, io.EOF) {
+		t.Fatalf("Receive on a closed pipe returned %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("closing both ends returned %v", err)
+	}
+}
+
+func TestServeTransportRelaysBetweenPipes(t *testing.T) {
+	s := newTestServer("")
+	sender := servePipe(t, s)
+	receiver := servePipe(t, s)
+	waitConns(t, s, 2)
+
+	if err := sender.Send(Message{Type: MessageTypeChat, Body: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if message := receive(t, receiver); message.Type != MessageTypeChat || message.Body != "hello" {
+		t.Fatalf("got %+v", message)
+	}
+	sender.Close()
+	waitConns(t, s, 1)
+}
+
+func TestBinaryAndTextFramesKeepTheirType(t *testing.T) {
+	s := newTestServer("")
+	url := startServer(t, s)
+	sender := connect(t, url, "", "", nil)
+	text := connect(t, url, "", "", nil)
+	json := connect(t, url, JSONProtocol, "", nil)
+	waitConns(t, s, 3)
+
+	data := []byte{0x00, 0xff, 'h', 'i', 0x80}
+	if err := sender.SendBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.Send("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got, binary, err := text.ReadFrame(); err != nil || !binary || !bytes.Equal(got, data) {
+		t.Fatalf("first frame was %q, binary %v, %v", got, binary, err)
+	}
+	if got, binary, err := text.ReadFrame(); err != nil || binary || string(got) != "hello" {
+		t.Fatalf("second frame was %q, binary %v, %v", got, binary, err)
+	}
+	// A JSON client can not get a binary frame, it gets the bytes intact in the envelope.
+	if message, err := json.ReadJSON(); err != nil || !message.Binary || message.Body != string(data) {
+		t.Fatalf("JSON client got %+v, %v", message, err)
+	}
+	if message, err := json.ReadJSON(); err != nil || message.Binary || message.Body != "hello" {
+		t.Fatalf("JSON client got %+v, %v", message, err)
+	}
+}
+
+func TestTransportIsRegisteredOnce(t *testing.T) {
+	s := newTestServer("")
+	client, server := NewPipe()
+	defer client.Close()
+	go s.ServeTransport(server)
+	waitConns(t, s, 1)
+	// The second call returns at once and leaves the first one serving.
+	s.ServeTransport(server)
+	if addrs := s.serverConnPool.GetPoolAddr(); len(addrs) != 1 {
+		t.Fatalf("pool holds %v, want the transport once", addrs)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Broadcast("once") }()
+	if message := receive(t, client); message.Body != "once" {
+		t.Fatalf("got %+v", message)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast is still sending, the transport got it twice")
+	}
+}
+
+// A flakyTransport fails its first failures sends with err, then sends through the Transport it wraps.
+type flakyTransport struct {
+	Transport
+	failures atomic.Int32
+	err      error
+}
+
+func (f *flakyTransport) Send(message Message) error {
+	if f.failures.Add(-1) >= 0 {
+		return f.err
+	}
+	return f.Transport.Send(message)
+}
+
+// Serves the server end of a pipe behind a flakyTransport, returns the client end.
+func serveFlaky(t *testing.T, s *ChatServer, failures int32, err error) Transport {
+	t.Helper()
+	client, server := NewPipe()
+	flaky := &flakyTransport{Transport: server, err: err}
+	flaky.failures.Store(failures)
+	go s.ServeTransport(flaky)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestTransientSendErrorsAreRetried(t *testing.T) {
+	s := newTestServer("")
+	client := serveFlaky(t, s, 2, fmt.Errorf("write: %w", syscall.EAGAIN))
+	waitConns(t, s, 1)
+
+	go s.Broadcast("hello")
+	if message := receive(t, client); message.Body != "hello" {
+		t.Fatalf("got %+v", message)
+	}
+	if n := len(s.serverConnPool.snapshot()); n != 1 {
+		t.Fatalf("%d connections, the busy one was unregistered", n)
+	}
+}
+
+func TestSendRetriesAreBounded(t *testing.T) {
+	s := newTestServer("")
+	s.SendRetries = 2
+	serveFlaky(t, s, 3, ErrTransient)
+	waitConns(t, s, 1)
+
+	if err := s.Broadcast("hello"); err == nil {
+		t.Fatal("Broadcast succeeded although every retry failed")
+	}
+	waitConns(t, s, 0)
+}